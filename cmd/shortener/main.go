@@ -2,64 +2,123 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	_ "github.com/lib/pq"
 	"github.com/pressly/goose/v3"
+	"google.golang.org/grpc/credentials"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	certs "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/certs"
+	config "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/config"
+	denylist "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/denylist"
+	grpcserver "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/grpcserver"
 	handlers "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/handlers"
+	metrics "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/metrics"
 	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	shortcode "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/shortcode"
 	storage "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
 )
 
 const (
-	command = "up"
-	dir     = "internal/migrations"
+	command   = "up"
+	dir       = "internal/migrations"
+	sqliteDir = "internal/migrations/sqlite"
+
+	deleteBatchSize    = 100
+	deleteInterval     = time.Second
+	clickFlushInterval = time.Second
 )
 
 func main() {
 	var (
 		st       storage.Storage
+		backend  string
+		fileItem *storage.File
+		mtr      *metrics.Metrics
 		err      error
-		server   = flag.String("a", os.Getenv("SERVER_ADDRESS"), "server address")
-		baseURL  = flag.String("b", os.Getenv("BASE_URL"), "base URL")
-		filePath = flag.String("f", os.Getenv("FILE_STORAGE_PATH"), "file location")
-		connStr  = flag.String("d", os.Getenv("DATABASE_DSN"), "connection url for DB")
+		offline  = flag.Bool("compact", false, "compact storage file and exit")
 	)
-	flag.Parse()
 
-	if *server == "" {
-		*server = "localhost:8080"
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if *baseURL == "" {
-		*baseURL = "http://localhost:8080/"
+	var keyRing *middleware.KeyRing
+
+	if cfg.SecretKey != "" {
+		parsedKeys, err := middleware.ParseKeys(cfg.SecretKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyRing = middleware.NewKeyRing(parsedKeys...)
+	} else if cfg.SecretKeyFile != "" {
+		keyRing, err = middleware.LoadKeyRing(cfg.SecretKeyFile)
+		if err != nil {
+			log.Fatalf("failed to load signing keys: %v", err)
+		}
+	} else {
+		log.Println("WARNING: signing keys are not configured, cookies will be invalid after restart.")
+		keyRing = middleware.NewKeyRing(middleware.NewRandomKey())
 	}
 
-	if len(strings.Split(*server, ":")) != 2 {
-		log.Fatal("Need address in a form host:port")
+	var denyList *denylist.List
+	if cfg.DenyListFile != "" {
+		if denyList, err = denylist.Load(cfg.DenyListFile); err != nil {
+			log.Fatalf("failed to load deny list: %v", err)
+		}
 	}
 
-	if bu := *baseURL; bu[len(bu)-1:] != "/" {
-		*baseURL = *baseURL + "/"
+	go watchSignals(keyRing, denyList)
+
+	if cfg.EnableMetrics {
+		mtr = metrics.New()
 	}
 
 	mwItem := &middleware.MiddlewareStruct{
-		SecretKey: middleware.SecretKey,
-		BaseURL:   *baseURL,
-		Server:    *server,
+		Keys:     keyRing,
+		TokenTTL: cfg.TokenTTL,
+		BaseURL:  cfg.BaseURL,
+		Server:   cfg.ServerAddress,
+		Secure:   cfg.EnableHTTPS,
+		Metrics:  mtr,
+		URLs:     middleware.URLPolicy{StripTrailingSlash: cfg.StripTrailingSlash},
+		RateLimits: map[string]middleware.RateLimit{
+			"/":                  cfg.RateLimitPost,
+			"/api/shorten":       cfg.RateLimitShorten,
+			"/api/shorten/batch": cfg.RateLimitBatch,
+		},
+	}
+	if cfg.TrustedSubnet != "" {
+		if _, mwItem.TrustedSubnet, err = net.ParseCIDR(cfg.TrustedSubnet); err != nil {
+			log.Fatalf("failed to parse trusted subnet: %v", err)
+		}
 	}
 
-	if *connStr != "" {
+	codes, err := shortcode.New(cfg.ShortCode, cfg.ShortCodeAlphabet, cfg.ShortCodeMinLength, cfg.ShortCodeKey)
+	if err != nil {
+		log.Fatalf("failed to configure short codes: %v", err)
+	}
+
+	if cfg.DatabaseDSN != "" {
 		log.Println("WARNING: saving will be done through DataBase.")
 
 		DBItem := &storage.Database{
-			BaseURL:   *baseURL,
-			DBConnURL: *connStr,
+			BaseURL:   cfg.BaseURL,
+			DBConnURL: cfg.DatabaseDSN,
+			Codes:     codes,
 		}
 		var dbErrorConnect error
 
@@ -71,67 +130,314 @@ func main() {
 			dbErrorConnect = err
 		}
 
-		defer pool.Close()
-
 		DBItem.ConnPool = pool
 		DBItem.DBErrorConnect = dbErrorConnect
+		if mtr != nil && pool != nil {
+			mtr.WatchPool(pool)
+		}
 
 		if DBItem.DBErrorConnect == nil {
-			db, err := goose.OpenDBWithDriver("pgx", *connStr)
+			db, err := goose.OpenDBWithDriver("pgx", cfg.DatabaseDSN)
 			if err != nil {
 				log.Fatalf("failed to open DB: %v\n", err)
 			}
 
-			defer func() {
-				if err := db.Close(); err != nil {
-					log.Fatalf("failed to close DB: %v\n", err)
-				}
-			}()
-
 			if err := goose.Run(command, db, dir); err != nil {
 				log.Fatalf("goose %v: %v", command, err)
 			} else {
 				log.Println("Success migration!")
 			}
+
+			if err := db.Close(); err != nil {
+				log.Fatalf("failed to close DB: %v\n", err)
+			}
+		}
+		st, backend = storage.Storage(DBItem), "database"
+
+	} else if cfg.DatabaseDSN == "" && cfg.SQLitePath != "" {
+		log.Println("WARNING: saving will be done through SQLite.")
+
+		sqliteItem := &storage.SQLite{
+			BaseURL: cfg.BaseURL,
+			Path:    cfg.SQLitePath,
+			Codes:   codes,
+		}
+
+		db, err := sqliteItem.GetDBConnection()
+		if err != nil {
+			log.Fatalf("failed to open SQLite DB: %v\n", err)
 		}
-		st = storage.Storage(DBItem)
+		sqliteItem.DB = db
 
-	} else if *connStr == "" && *filePath != "" {
+		if err := goose.SetDialect("sqlite3"); err != nil {
+			log.Fatalf("goose: %v", err)
+		}
+		if err := goose.Run(command, db, sqliteDir); err != nil {
+			log.Fatalf("goose %v: %v", command, err)
+		} else {
+			log.Println("Success migration!")
+		}
+		st, backend = storage.Storage(sqliteItem), "sqlite"
+
+	} else if cfg.DatabaseDSN == "" && cfg.SQLitePath == "" && cfg.FileStoragePath != "" {
 		log.Println("WARNING: saving will be done through file.")
 
-		fileItem := &storage.File{
-			BaseURL:  *baseURL,
-			Filepath: *filePath,
-			ID:       0,
-			URLID:    make(map[string]int),
-			IDURL:    make(map[int]string),
-			UserURLs: make(map[string][]int),
+		fileItem = &storage.File{
+			BaseURL:   cfg.BaseURL,
+			Filepath:  cfg.FileStoragePath,
+			ID:        0,
+			URLID:     make(map[string]int),
+			IDURL:     make(map[int]string),
+			UserURLs:  make(map[string][]int),
+			Deleted:   make(map[int]bool),
+			Aliases:   make(map[string]int),
+			IDAlias:   make(map[int]string),
+			CodeKinds: make(map[int]string),
+			ExpiresAt: make(map[int]time.Time),
+			Clicks:    make(map[int]*storage.ClickStats),
+			Codes:     codes,
 		}
 
-		if _, err := os.Stat(*filePath); os.IsNotExist(err) {
-			middleware.CreateFile(*filePath)
+		// clicks are loaded first, the compaction rewrites the clicks file along with the journal
+		if err := fileItem.LoadClicks(); err != nil {
+			log.Fatalf("failed to load click statistics: %v", err)
+		}
+		if _, err := os.Stat(cfg.FileStoragePath); os.IsNotExist(err) {
+			middleware.CreateFile(cfg.FileStoragePath)
 		} else {
-			targets := middleware.InitMapByJSON(*filePath)
-			fileItem.NewFromFile(*baseURL, targets)
+			targets, skipped, err := middleware.InitMapByJSON(cfg.FileStoragePath, cfg.FileStorageRecover)
+			if err != nil {
+				log.Fatalf("failed to load storage file, run with -recover to skip corrupt records: %v", err)
+			}
+			if len(skipped) > 0 {
+				reportSkipped(cfg.FileStoragePath, skipped)
+			}
+			fileItem.NewFromFile(cfg.BaseURL, targets)
+			if err := fileItem.Compact(); err != nil {
+				log.Fatalf("failed to compact storage file: %v", err)
+			}
+		}
+		if *offline {
+			log.Println("storage file", cfg.FileStoragePath, "compacted")
+			return
 		}
-		st = storage.Storage(fileItem)
+		st, backend = storage.Storage(fileItem), "file"
 
-	} else if *connStr == "" && *filePath == "" {
+	} else if cfg.DatabaseDSN == "" && cfg.SQLitePath == "" && cfg.FileStoragePath == "" {
 		log.Println("WARNING: saving will be done through memory.")
 		memoryItem := &storage.Memory{
-			BaseURL:  *baseURL,
-			ID:       0,
-			URLID:    make(map[string]int),
-			IDURL:    make(map[int]string),
-			UserURLs: make(map[string][]int),
+			BaseURL:   cfg.BaseURL,
+			ID:        0,
+			URLID:     make(map[string]int),
+			IDURL:     make(map[int]string),
+			UserURLs:  make(map[string][]int),
+			Deleted:   make(map[int]bool),
+			Aliases:   make(map[string]int),
+			IDAlias:   make(map[int]string),
+			ExpiresAt: make(map[int]time.Time),
+			Clicks:    make(map[int]*storage.ClickStats),
+			Codes:     codes,
 		}
 
-		st = storage.Storage(memoryItem)
+		st, backend = storage.Storage(memoryItem), "memory"
+	}
+
+	if mtr != nil {
+		st = &storage.Observed{Storage: st, Backend: backend, Observer: mtr}
+	}
+	if denyList != nil {
+		st = &storage.Checked{Storage: st, Checker: denyList}
+	}
+	selfLinks, err := storage.NewSelfLinks(st, cfg.MaxRedirectDepth, cfg.ShortBaseURLs()...)
+	if err != nil {
+		log.Fatalf("failed to configure short domains: %v", err)
+	}
+	st = selfLinks
+
+	var workers sync.WaitGroup
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runWorker := func(run func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run()
+		}()
+	}
+
+	deleter := storage.NewDeleteWorker(st, deleteBatchSize, deleteInterval)
+	runWorker(func() { deleter.Run(ctx) })
+
+	runWorker(func() { storage.RunReaper(ctx, st, cfg.ReapInterval) })
+
+	if fileItem != nil {
+		runWorker(func() { storage.RunClickFlusher(ctx, fileItem, clickFlushInterval) })
+		runWorker(func() { storage.RunCompactor(ctx, fileItem, cfg.CompactInterval) })
+	}
+
+	var handler http.Handler = handlers.NewRouter(st, *mwItem, deleter)
+	servers := []*http.Server{{Addr: ":" + strings.Split(cfg.ServerAddress, ":")[1]}}
+	srv := servers[0]
+
+	if mtr != nil && cfg.MetricsAddress == "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", mtr.Handler())
+		mux.Handle("/", handler)
+		handler = mux
+	} else if mtr != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", mtr.Handler())
+		servers = append(servers, &http.Server{Addr: cfg.MetricsAddress, Handler: mux})
 	}
+	srv.Handler = handler
 
-	if err = http.ListenAndServe(":"+strings.Split(*server, ":")[1],
-		handlers.NewRouter(st, *mwItem)); err != http.ErrServerClosed {
+	var grpcCreds credentials.TransportCredentials
+	if cfg.EnableHTTPS {
+		if cfg.TLSCertFile == "" {
+			log.Println("WARNING: TLS certificate is not configured, self-signed one is used.")
+		}
+
+		cert, err := certs.Load(cfg.TLSCertFile, cfg.TLSKeyFile, certHosts(cfg.ServerAddress, cfg.BaseURL)...)
+		if err != nil {
+			log.Fatalf("failed to load TLS certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		grpcCreds = credentials.NewTLS(srv.TLSConfig.Clone())
+	}
+
+	drainers := []drainer{srv}
+	for _, admin := range servers[1:] {
+		drainers = append(drainers, admin)
+	}
+
+	serveErr := make(chan error, len(servers)+1)
+	go func() {
+		if cfg.EnableHTTPS {
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	for _, admin := range servers[1:] {
+		admin := admin
+		log.Println("metrics are served on", admin.Addr)
+		go func() {
+			serveErr <- admin.ListenAndServe()
+		}()
+	}
+
+	if cfg.GRPCAddress != "" {
+		grpcSrv := grpcserver.New(cfg.GRPCAddress, st, *mwItem, grpcCreds)
+		drainers = append(drainers, grpcSrv)
+		log.Println("gRPC API is served on", cfg.GRPCAddress)
+		go func() {
+			serveErr <- grpcSrv.ListenAndServe()
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	select {
+	case err := <-serveErr:
 		log.Fatalf("HTTP server ListenAndServe Error: %v", err)
+	case sig := <-sigs:
+		log.Println("got", sig, "signal, shutting down")
+	}
+
+	stopWorkers := func() {
+		cancel()
+		workers.Wait()
+	}
+	if err := shutdown(drainers, cfg.ShutdownTimeout, stopWorkers, st); err != nil {
+		log.Printf("shutdown failed: %v", err)
+		os.Exit(1)
+	}
+	log.Println("server stopped")
+}
+
+// drainer is a server which can stop accepting requests and wait for the running ones
+type drainer interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shutdown stops accepting requests and waits for the running ones, then stops the workers,
+// so deletions queued by the last requests are flushed before the storage is closed
+func shutdown(servers []drainer, timeout time.Duration, stopWorkers func(), st storage.Storage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var drainErr error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && drainErr == nil {
+			drainErr = fmt.Errorf("requests were not drained in %v: %w", timeout, err)
+		}
+	}
+
+	stopWorkers()
+
+	if err := st.Close(); err != nil {
+		log.Printf("failed to close storage: %v", err)
+		if drainErr == nil {
+			return err
+		}
+	}
+	return drainErr
+}
+
+// certHosts lists the names a self-signed certificate is issued for
+func certHosts(server string, baseURL string) []string {
+	hosts := []string{strings.Split(server, ":")[0]}
+	if u, err := url.Parse(baseURL); err == nil && u.Hostname() != hosts[0] {
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
+
+func reportSkipped(filePath string, skipped []middleware.SkippedRecord) {
+	for _, record := range skipped {
+		log.Printf("WARNING: skipped corrupt record %d of %s: %s", record.Line, filePath, record.Reason)
+	}
+
+	backupPath := filePath + ".corrupt"
+	data, err := os.ReadFile(filePath)
+	if err == nil {
+		err = os.WriteFile(backupPath, data, 0644)
+	}
+	if err != nil {
+		log.Fatalf("failed to back up corrupt storage file: %v", err)
 	}
+	log.Println("WARNING:", len(skipped), "corrupt records were skipped, original file is kept in", backupPath)
+}
 
+// watchSignals reloads signing keys and the deny list on SIGHUP and rotates keys on SIGUSR1
+func watchSignals(keyRing *middleware.KeyRing, denyList *denylist.List) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1)
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			if err := keyRing.Reload(); err != nil {
+				log.Printf("failed to reload signing keys: %v", err)
+			} else {
+				log.Println("signing keys reloaded")
+			}
+			if denyList != nil {
+				if err := denyList.Reload(); err != nil {
+					log.Printf("failed to reload deny list: %v", err)
+				} else {
+					log.Println("deny list reloaded")
+				}
+			}
+		case syscall.SIGUSR1:
+			if key, err := keyRing.Rotate(); err != nil {
+				log.Printf("failed to rotate signing keys: %v", err)
+			} else {
+				log.Println("new signing key", key.ID, "is used from now on")
+			}
+		}
+	}
 }
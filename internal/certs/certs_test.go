@@ -0,0 +1,43 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelfSigned(t *testing.T) {
+	cert, err := SelfSigned("localhost", "127.0.0.1", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost"}, cert.Leaf.DNSNames)
+	require.Len(t, cert.Leaf.IPAddresses, 1)
+	assert.True(t, cert.Leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestLoad(t *testing.T) {
+	_, err := Load("missing.crt", "missing.key")
+	assert.Error(t, err)
+
+	cert, err := Load("", "", "localhost")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"localhost"}, cert.Leaf.DNSNames)
+}
@@ -0,0 +1,394 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultServerAddress   = "localhost:8080"
+	DefaultBaseURL         = "http://localhost:8080/"
+	DefaultReapInterval    = time.Minute
+	DefaultCompactInterval = 10 * time.Minute
+	DefaultShutdownTimeout = 10 * time.Second
+
+	DefaultMaxRedirectDepth = 5
+)
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+type Config struct {
+	ServerAddress      string
+	BaseURL            string
+	FileStoragePath    string
+	FileStorageRecover bool
+	DatabaseDSN        string
+	SQLitePath         string
+
+	SecretKeyFile string
+	SecretKey     string
+	TokenTTL      time.Duration
+
+	ShortCode          string
+	ShortCodeAlphabet  string
+	ShortCodeMinLength int
+	ShortCodeKey       uint64
+
+	ReapInterval    time.Duration
+	CompactInterval time.Duration
+	ShutdownTimeout time.Duration
+
+	EnableHTTPS bool
+	TLSCertFile string
+	TLSKeyFile  string
+
+	EnableMetrics  bool
+	MetricsAddress string
+
+	GRPCAddress string
+
+	TrustedSubnet string
+
+	StripTrailingSlash bool
+	DenyListFile       string
+
+	ShortDomains     string
+	MaxRedirectDepth int
+
+	RateLimitPost    middleware.RateLimit
+	RateLimitShorten middleware.RateLimit
+	RateLimitBatch   middleware.RateLimit
+}
+
+func Default() Config {
+	return Config{
+		ServerAddress:   DefaultServerAddress,
+		BaseURL:         DefaultBaseURL,
+		TokenTTL:        middleware.DefaultTokenTTL,
+		ReapInterval:    DefaultReapInterval,
+		CompactInterval: DefaultCompactInterval,
+		ShutdownTimeout: DefaultShutdownTimeout,
+
+		MaxRedirectDepth: DefaultMaxRedirectDepth,
+	}
+}
+
+// option is a single setting, it is named flag on the command line, env in environment and key in config file
+type option struct {
+	flag, env, key string
+	usage          string
+	boolean        bool
+	set            func(c *Config, value string) error
+}
+
+func stringOption(flag, env, key, usage string, field func(c *Config) *string) option {
+	return option{flag: flag, env: env, key: key, usage: usage, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func boolOption(flag, env, key, usage string, field func(c *Config) *bool) option {
+	return option{flag: flag, env: env, key: key, usage: usage, boolean: true, set: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		*field(c) = b
+		return err
+	}}
+}
+
+func durationOption(flag, env, key, usage string, field func(c *Config) *time.Duration) option {
+	return option{flag: flag, env: env, key: key, usage: usage, set: func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("duration must be positive, got %v", d)
+		}
+		*field(c) = d
+		return err
+	}}
+}
+
+func rateLimitOption(flag, env, key, route string, field func(c *Config) *middleware.RateLimit) option {
+	usage := fmt.Sprintf("rate limit of %s per user and per IP, like 10/s or 100/m:20 with a burst, unlimited if empty", route)
+	return option{flag: flag, env: env, key: key, usage: usage, set: func(c *Config, value string) (err error) {
+		*field(c), err = middleware.ParseRateLimit(value)
+		return err
+	}}
+}
+
+var options = []option{
+	stringOption("a", "SERVER_ADDRESS", "server_address", "server address",
+		func(c *Config) *string { return &c.ServerAddress }),
+	stringOption("b", "BASE_URL", "base_url", "base URL",
+		func(c *Config) *string { return &c.BaseURL }),
+	stringOption("f", "FILE_STORAGE_PATH", "file_storage_path", "file location",
+		func(c *Config) *string { return &c.FileStoragePath }),
+	boolOption("recover", "FILE_STORAGE_RECOVER", "file_storage_recover",
+		"skip corrupt records of storage file instead of failing",
+		func(c *Config) *bool { return &c.FileStorageRecover }),
+	stringOption("d", "DATABASE_DSN", "database_dsn", "connection url for DB",
+		func(c *Config) *string { return &c.DatabaseDSN }),
+	stringOption("sqlite", "SQLITE_PATH", "sqlite_path", "SQLite database location",
+		func(c *Config) *string { return &c.SQLitePath }),
+	stringOption("k", "SECRET_KEY_FILE", "secret_key_file", "file with cookie signing keys",
+		func(c *Config) *string { return &c.SecretKeyFile }),
+	stringOption("sk", "SECRET_KEY", "secret_key", "cookie signing keys in a form id:hexsecret,...",
+		func(c *Config) *string { return &c.SecretKey }),
+	durationOption("token-ttl", "TOKEN_TTL", "token_ttl", "lifetime of issued bearer tokens",
+		func(c *Config) *time.Duration { return &c.TokenTTL }),
+	stringOption("code", "SHORT_CODE", "short_code", "short code generator: numeric or base62",
+		func(c *Config) *string { return &c.ShortCode }),
+	stringOption("code-alphabet", "SHORT_CODE_ALPHABET", "short_code_alphabet", "alphabet of short codes",
+		func(c *Config) *string { return &c.ShortCodeAlphabet }),
+	{flag: "code-min-len", env: "SHORT_CODE_MIN_LENGTH", key: "short_code_min_length",
+		usage: "minimal length of short codes", set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err == nil && n < 0 {
+				err = fmt.Errorf("length must not be negative, got %d", n)
+			}
+			c.ShortCodeMinLength = n
+			return err
+		}},
+	{flag: "code-key", env: "SHORT_CODE_KEY", key: "short_code_key",
+		usage: "key to obfuscate IDs in short codes", set: func(c *Config, value string) (err error) {
+			c.ShortCodeKey, err = strconv.ParseUint(value, 10, 64)
+			return err
+		}},
+	durationOption("reap-interval", "REAP_INTERVAL", "reap_interval", "how often expired urls are purged",
+		func(c *Config) *time.Duration { return &c.ReapInterval }),
+	durationOption("compact-interval", "COMPACT_INTERVAL", "compact_interval", "how often storage file is compacted",
+		func(c *Config) *time.Duration { return &c.CompactInterval }),
+	durationOption("shutdown-timeout", "SHUTDOWN_TIMEOUT", "shutdown_timeout",
+		"how long running requests are waited on shutdown",
+		func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	boolOption("s", "ENABLE_HTTPS", "enable_https", "serve HTTPS",
+		func(c *Config) *bool { return &c.EnableHTTPS }),
+	stringOption("tls-cert", "TLS_CERT_FILE", "tls_cert_file", "TLS certificate, self-signed one is used if empty",
+		func(c *Config) *string { return &c.TLSCertFile }),
+	stringOption("tls-key", "TLS_KEY_FILE", "tls_key_file", "TLS private key",
+		func(c *Config) *string { return &c.TLSKeyFile }),
+	boolOption("metrics", "ENABLE_METRICS", "enable_metrics", "expose Prometheus metrics on /metrics",
+		func(c *Config) *bool { return &c.EnableMetrics }),
+	stringOption("metrics-addr", "METRICS_ADDRESS", "metrics_address",
+		"separate admin address for /metrics, the main server is used if empty",
+		func(c *Config) *string { return &c.MetricsAddress }),
+	stringOption("g", "GRPC_ADDRESS", "grpc_address", "gRPC server address, gRPC API is off if empty",
+		func(c *Config) *string { return &c.GRPCAddress }),
+	stringOption("t", "TRUSTED_SUBNET", "trusted_subnet", "CIDR allowed to read internal stats and of proxies whose X-Real-IP rate limits trust, stats are closed if empty",
+		func(c *Config) *string { return &c.TrustedSubnet }),
+	boolOption("strip-trailing-slash", "STRIP_TRAILING_SLASH", "strip_trailing_slash",
+		"drop trailing slashes of URL paths before they are stored",
+		func(c *Config) *bool { return &c.StripTrailingSlash }),
+	stringOption("denylist", "DENYLIST_FILE", "denylist_file",
+		"file of denied domains and /regexps/ of URLs, reloaded on SIGHUP",
+		func(c *Config) *string { return &c.DenyListFile }),
+	stringOption("short-domains", "SHORT_DOMAINS", "short_domains",
+		"comma separated base URLs the short URLs are also served at besides the base URL",
+		func(c *Config) *string { return &c.ShortDomains }),
+	{flag: "max-redirect-depth", env: "MAX_REDIRECT_DEPTH", key: "max_redirect_depth",
+		usage: "how many short URLs are followed to collapse a URL pointing back at the shortener, 0 rejects them",
+		set: func(c *Config, value string) error {
+			n, err := strconv.Atoi(value)
+			if err == nil && n < 0 {
+				err = fmt.Errorf("depth must not be negative, got %d", n)
+			}
+			c.MaxRedirectDepth = n
+			return err
+		}},
+	rateLimitOption("rate-limit-post", "RATE_LIMIT_POST", "rate_limit_post", "POST /",
+		func(c *Config) *middleware.RateLimit { return &c.RateLimitPost }),
+	rateLimitOption("rate-limit-shorten", "RATE_LIMIT_SHORTEN", "rate_limit_shorten", "POST /api/shorten",
+		func(c *Config) *middleware.RateLimit { return &c.RateLimitShorten }),
+	rateLimitOption("rate-limit-batch", "RATE_LIMIT_BATCH", "rate_limit_batch", "POST /api/shorten/batch",
+		func(c *Config) *middleware.RateLimit { return &c.RateLimitBatch }),
+}
+
+// Load builds the config from defaults, the config file, environment and flags,
+// each of them overrides the ones before it
+func Load(fs *flag.FlagSet, args []string, getenv func(string) string) (Config, error) {
+	cfg := Default()
+
+	path := fs.String("c", getenv("CONFIG"), "config file, JSON or YAML")
+	flagValues := make(map[string]*string, len(options))
+	for _, opt := range options {
+		if opt.boolean {
+			flagValues[opt.flag] = new(string)
+			fs.Var(boolFlag{flagValues[opt.flag]}, opt.flag, opt.usage)
+		} else {
+			flagValues[opt.flag] = fs.String(opt.flag, "", opt.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return cfg, err
+		}
+	}
+
+	for _, opt := range options {
+		if value := getenv(opt.env); value != "" {
+			if err := opt.set(&cfg, value); err != nil {
+				return cfg, fmt.Errorf("%w: env %s: %v", ErrInvalidConfig, opt.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, opt := range options {
+			if opt.flag == f.Name && err == nil {
+				if setErr := opt.set(&cfg, *flagValues[opt.flag]); setErr != nil {
+					err = fmt.Errorf("%w: flag -%s: %v", ErrInvalidConfig, opt.flag, setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// boolFlag keeps a boolean flag usable without a value, like -s
+type boolFlag struct {
+	value *string
+}
+
+func (b boolFlag) String() string   { return "" }
+func (b boolFlag) IsBoolFlag() bool { return true }
+func (b boolFlag) Set(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return err
+	}
+	*b.value = value
+	return nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		opt, ok := optionByKey(key)
+		if !ok {
+			return fmt.Errorf("%w: %s: unknown option %q", ErrInvalidConfig, path, key)
+		}
+
+		var value string
+		switch v := values[key].(type) {
+		case string:
+			value = v
+		case bool, int, uint64, json.Number:
+			value = fmt.Sprint(v)
+		default:
+			return fmt.Errorf("%w: %s: %s must be a string, number or boolean", ErrInvalidConfig, path, key)
+		}
+		if err := opt.set(c, value); err != nil {
+			return fmt.Errorf("%w: %s: %s: %v", ErrInvalidConfig, path, key, err)
+		}
+	}
+	return nil
+}
+
+func optionByKey(key string) (option, bool) {
+	for _, opt := range options {
+		if opt.key == key {
+			return opt, true
+		}
+	}
+	return option{}, false
+}
+
+// Validate checks the settings depending on each other and brings BaseURL to the form handlers expect
+func (c *Config) Validate() error {
+	if len(strings.Split(c.ServerAddress, ":")) != 2 {
+		return fmt.Errorf("%w: server address %q must be in a form host:port", ErrInvalidConfig, c.ServerAddress)
+	}
+
+	if c.EnableHTTPS {
+		c.BaseURL = "https://" + strings.TrimPrefix(c.BaseURL, "http://")
+	}
+	if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: base URL %q must be an absolute http(s) URL", ErrInvalidConfig, c.BaseURL)
+	}
+	if !strings.HasSuffix(c.BaseURL, "/") {
+		c.BaseURL += "/"
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("%w: TLS certificate and key must be given together", ErrInvalidConfig)
+	}
+
+	if c.MetricsAddress != "" {
+		if !c.EnableMetrics {
+			return fmt.Errorf("%w: metrics address is set, but metrics are not enabled", ErrInvalidConfig)
+		} else if len(strings.Split(c.MetricsAddress, ":")) != 2 {
+			return fmt.Errorf("%w: metrics address %q must be in a form host:port", ErrInvalidConfig, c.MetricsAddress)
+		}
+	}
+
+	if c.GRPCAddress != "" && len(strings.Split(c.GRPCAddress, ":")) != 2 {
+		return fmt.Errorf("%w: gRPC address %q must be in a form host:port", ErrInvalidConfig, c.GRPCAddress)
+	}
+
+	for _, domain := range c.ShortBaseURLs()[1:] {
+		if u, err := url.Parse(domain); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: short domain %q must be an absolute http(s) URL", ErrInvalidConfig, domain)
+		}
+	}
+
+	if c.TrustedSubnet != "" {
+		if _, _, err := net.ParseCIDR(c.TrustedSubnet); err != nil {
+			return fmt.Errorf("%w: trusted subnet %q must be in CIDR notation", ErrInvalidConfig, c.TrustedSubnet)
+		}
+	}
+	return nil
+}
+
+// ShortBaseURLs are BaseURL followed by ShortDomains, short URLs of the service may start with any of them
+func (c Config) ShortBaseURLs() []string {
+	baseURLs := []string{c.BaseURL}
+	for _, domain := range strings.Split(c.ShortDomains, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			baseURLs = append(baseURLs, domain)
+		}
+	}
+	return baseURLs
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"flag"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func load(t *testing.T, args []string, env map[string]string) (Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("shortener", flag.ContinueOnError)
+	return Load(fs, args, func(key string) string { return env[key] })
+}
+
+func writeFile(t *testing.T, name string, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+	return path
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, err := load(t, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestPrecedence(t *testing.T) {
+	path := writeFile(t, "config.json", `{
+		"server_address": "localhost:8081",
+		"base_url": "http://file.example/",
+		"file_storage_path": "/tmp/file.json",
+		"database_dsn": "postgres://file",
+		"token_ttl": "2h",
+		"short_code_min_length": 4,
+		"enable_https": false
+	}`)
+
+	cfg, err := load(t, []string{"-c", path, "-a", "localhost:8083", "-s"}, map[string]string{
+		"SERVER_ADDRESS": "localhost:8082",
+		"BASE_URL":       "http://env.example",
+		"TOKEN_TTL":      "3h",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "localhost:8083", cfg.ServerAddress)
+	assert.Equal(t, "https://env.example/", cfg.BaseURL)
+	assert.Equal(t, "/tmp/file.json", cfg.FileStoragePath)
+	assert.Equal(t, "postgres://file", cfg.DatabaseDSN)
+	assert.Equal(t, 3*time.Hour, cfg.TokenTTL)
+	assert.Equal(t, 4, cfg.ShortCodeMinLength)
+	assert.True(t, cfg.EnableHTTPS)
+	assert.Equal(t, DefaultReapInterval, cfg.ReapInterval)
+}
+
+func TestRateLimits(t *testing.T) {
+	cfg, err := load(t, []string{"-rate-limit-post", "10/s"}, map[string]string{
+		"RATE_LIMIT_SHORTEN": "100/m:20",
+		"RATE_LIMIT_BATCH":   "30/5m",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, middleware.RateLimit{Rate: 10, Burst: 10}, cfg.RateLimitPost)
+	assert.Equal(t, 20, cfg.RateLimitShorten.Burst)
+	assert.InDelta(t, 100.0/60, cfg.RateLimitShorten.Rate, 1e-9)
+	assert.Equal(t, middleware.RateLimit{Rate: 0.1, Burst: 30}, cfg.RateLimitBatch)
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	path := writeFile(t, "config.yaml", "server_address: localhost:9090\nshort_code_key: 12345\nenable_https: true\n")
+
+	cfg, err := load(t, nil, map[string]string{"CONFIG": path})
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:9090", cfg.ServerAddress)
+	assert.Equal(t, uint64(12345), cfg.ShortCodeKey)
+	assert.Equal(t, "https://localhost:8080/", cfg.BaseURL)
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		env  map[string]string
+		msg  string
+	}{
+		{name: "missing file", args: []string{"-c", "missing.json"}, msg: "missing.json"},
+		{name: "broken json", file: `{"server_address": `, msg: "config.json"},
+		{name: "unknown option", file: `{"server": "localhost:8080"}`, msg: `unknown option "server"`},
+		{name: "wrong type", file: `{"server_address": ["localhost"]}`, msg: "server_address must be"},
+		{name: "bad duration in file", file: `{"reap_interval": "often"}`, msg: "reap_interval"},
+		{name: "bad env", env: map[string]string{"TOKEN_TTL": "-1h"}, msg: "env TOKEN_TTL"},
+		{name: "bad flag", args: []string{"-code-min-len", "x"}, msg: "flag -code-min-len"},
+		{name: "server address", args: []string{"-a", "localhost"}, msg: "host:port"},
+		{name: "base URL", args: []string{"-b", "1000"}, msg: "base URL"},
+		{name: "TLS pair", args: []string{"-s", "-tls-cert", "server.crt"}, msg: "TLS certificate and key"},
+		{name: "metrics off", args: []string{"-metrics-addr", "localhost:9100"}, msg: "metrics are not enabled"},
+		{name: "metrics address", args: []string{"-metrics", "-metrics-addr", "9100"}, msg: "metrics address"},
+		{name: "gRPC address", args: []string{"-g", "3200"}, msg: "gRPC address"},
+		{name: "rate limit", args: []string{"-rate-limit-batch", "10/fortnight"}, msg: "flag -rate-limit-batch"},
+		{name: "rate limit burst", file: `{"rate_limit_post": "10/s:0"}`, msg: "rate_limit_post"},
+		{name: "short domain", env: map[string]string{"SHORT_DOMAINS": "https://sho.rt/, sho.rt"}, msg: "short domain"},
+		{name: "redirect depth", args: []string{"-max-redirect-depth", "-1"}, msg: "flag -max-redirect-depth"},
+		{name: "trusted subnet", env: map[string]string{"TRUSTED_SUBNET": "10.0.0.1"}, msg: "trusted subnet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-c", writeFile(t, "config.json", tt.file)}, args...)
+			}
+			_, err := load(t, args, tt.env)
+			require.Error(t, err)
+			assert.ErrorIs(t, err, ErrInvalidConfig)
+			assert.Contains(t, err.Error(), tt.msg)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package denylist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// List blocks URLs by the rules of a file, one rule per line:
+// a domain blocks itself with all subdomains, a /regexp/ is matched against the whole URL,
+// blank lines and lines starting with # are skipped
+type List struct {
+	path string
+
+	mu       sync.RWMutex
+	domains  map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func Load(path string) (*List, error) {
+	l := &List{path: path}
+	return l, l.Reload()
+}
+
+// Reload replaces the rules with the ones in the file, the old rules stay in place if the file is broken
+func (l *List) Reload() error {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	domains, patterns, err := parse(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse deny list %s: %w", l.path, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.domains, l.patterns = domains, patterns
+	return nil
+}
+
+func parse(data []byte) (map[string]bool, []*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	domains := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		rule := strings.TrimSpace(scanner.Text())
+		switch {
+		case rule == "" || strings.HasPrefix(rule, "#"):
+			continue
+		case len(rule) > 1 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/"):
+			pattern, err := regexp.Compile(rule[1 : len(rule)-1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			patterns = append(patterns, pattern)
+		default:
+			domain, err := middleware.CanonicalHost(strings.TrimSuffix(rule, "."))
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			domains[domain] = true
+		}
+	}
+	return domains, patterns, scanner.Err()
+}
+
+func (l *List) CheckURL(_ context.Context, rawURL string) error {
+	// stored urls may predate canonicalization, so the host is brought to the form of the rules here as well
+	var host string
+	if u, err := url.Parse(rawURL); err == nil {
+		host = strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	}
+	if canonical, err := middleware.CanonicalHost(host); err == nil {
+		host = canonical
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	for host != "" {
+		if l.domains[host] {
+			return fmt.Errorf("%w: domain %s is denied", middleware.ErrBlockedURL, host)
+		}
+		_, parent, found := strings.Cut(host, ".")
+		if !found {
+			break
+		}
+		host = parent
+	}
+	for _, pattern := range l.patterns {
+		if pattern.MatchString(rawURL) {
+			return fmt.Errorf("%w: URL matches %s", middleware.ErrBlockedURL, pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package denylist
+
+import (
+	"context"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# phishing\nEvil.example\nпример.рф.\n\n/[?&]redirect=/\n"), 0644))
+
+	l, err := Load(path)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, url := range []string{
+		"https://evil.example/",
+		"https://login.EVIL.example/account",
+		"https://xn--e1afmkfd.xn--p1ai/",
+		"https://пример.рф/legacy",
+		"https://go.dev/?a=1&redirect=https://evil.example",
+	} {
+		assert.ErrorIs(t, l.CheckURL(ctx, url), middleware.ErrBlockedURL, url)
+	}
+	for _, url := range []string{"https://go.dev/", "https://notevil.example/", "https://example/", "::"} {
+		assert.NoError(t, l.CheckURL(ctx, url), url)
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("go.dev\n"), 0644))
+	require.NoError(t, l.Reload())
+	assert.ErrorIs(t, l.CheckURL(ctx, "https://go.dev/"), middleware.ErrBlockedURL)
+	assert.NoError(t, l.CheckURL(ctx, "https://evil.example/"))
+
+	require.NoError(t, os.WriteFile(path, []byte("/(/\n"), 0644))
+	err = l.Reload()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "line 1")
+	assert.ErrorIs(t, l.CheckURL(ctx, "https://go.dev/"), middleware.ErrBlockedURL, "broken list must keep the old rules")
+}
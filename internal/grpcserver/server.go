@@ -0,0 +1,246 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	m "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	pb "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/proto"
+	s "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	MetadataUserID   = "user-id"
+	MetadataUserSign = "user-sign"
+)
+
+type ShortenerServer struct {
+	pb.UnimplementedShortenerServer
+
+	storage s.Storage
+	mw      m.MiddlewareStruct
+}
+
+// Server runs the gRPC API next to the HTTP one, it has Shutdown to be stopped the same way as http.Server
+type Server struct {
+	*grpc.Server
+	Addr string
+}
+
+func New(addr string, storage s.Storage, mw m.MiddlewareStruct, creds credentials.TransportCredentials) *Server {
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(Auth(mw))}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	srv := grpc.NewServer(opts...)
+	pb.RegisterShortenerServer(srv, &ShortenerServer{storage: storage, mw: mw})
+	return &Server{Server: srv, Addr: addr}
+}
+
+func (srv *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(listener)
+}
+
+// Shutdown waits for running calls like http.Server.Shutdown, the ones still running when ctx is done are cut off
+func (srv *Server) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		srv.Stop()
+		return ctx.Err()
+	}
+}
+
+// Auth identifies the caller the same way as CheckAuth does with cookies,
+// credentials of a new user or ones re-signed with the current key are sent in response headers
+func Auth(mw m.MiddlewareStruct) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		first := func(key string) string {
+			if values := md.Get(key); len(values) > 0 {
+				return values[0]
+			}
+			return ""
+		}
+
+		if token, found := m.BearerToken(first("authorization")); found {
+			userID, err := mw.ParseToken(token)
+			if err != nil {
+				return nil, status.Error(codes.Unauthenticated, "invalid token")
+			}
+			return handler(context.WithValue(ctx, m.UserIDKey{}, userID), req)
+		}
+
+		userID, renew := mw.Identify(first(MetadataUserID), first(MetadataUserSign))
+		if renew {
+			sign, err := mw.Keys.Sign(userID)
+			if err != nil {
+				log.Printf("failed to sign user id: %v", err)
+				return nil, status.Error(codes.Internal, "failed to sign user id")
+			}
+			if err := grpc.SetHeader(ctx, metadata.Pairs(MetadataUserID, userID, MetadataUserSign, sign)); err != nil {
+				return nil, err
+			}
+		}
+		return handler(context.WithValue(ctx, m.UserIDKey{}, userID), req)
+	}
+}
+
+func user(ctx context.Context) string {
+	userID, _ := ctx.Value(m.UserIDKey{}).(string)
+	return userID
+}
+
+func expiry(expiresAt *timestamppb.Timestamp, ttl int64) (time.Time, error) {
+	var at *time.Time
+	if expiresAt != nil {
+		t := expiresAt.AsTime()
+		at = &t
+	}
+	return m.ExpiryTime(at, ttl, time.Now())
+}
+
+func (ss *ShortenerServer) Shorten(ctx context.Context, req *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	fullURL, err := ss.mw.URLs.Canonicalize(req.GetUrl())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid URL, it must be an absolute http(s) URL")
+	}
+	expiresAt, err := expiry(req.GetExpiresAt(), req.GetTtl())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid expiration")
+	}
+
+	shortURL, err := ss.storage.AddURL(ctx, s.URL{
+		FullURL:   fullURL,
+		Alias:     req.GetAlias(),
+		ExpiresAt: expiresAt,
+	}, user(ctx))
+	switch {
+	case err == nil:
+		return &pb.ShortenResponse{ShortUrl: shortURL}, nil
+	case errors.Is(err, m.ErrConflict):
+		return &pb.ShortenResponse{ShortUrl: shortURL, Existing: true}, nil
+	case errors.Is(err, m.ErrBlockedURL):
+		return nil, status.Error(codes.PermissionDenied, "URL is blocked")
+	case errors.Is(err, m.ErrRedirectLoop):
+		return nil, status.Error(codes.InvalidArgument, "URL points back at the shortener")
+	case errors.Is(err, m.ErrAliasConflict):
+		return nil, status.Error(codes.AlreadyExists, "alias is already taken")
+	case errors.Is(err, m.ErrInvalidAlias):
+		return nil, status.Error(codes.InvalidArgument, "invalid alias")
+	default:
+		log.Printf("unable to add url: %v", err)
+		return nil, status.Error(codes.Internal, "error wile add URL to storage")
+	}
+}
+
+func (ss *ShortenerServer) ShortenBatch(ctx context.Context, req *pb.ShortenBatchRequest) (*pb.ShortenBatchResponse, error) {
+	var (
+		urls      []s.URL
+		positions []int
+	)
+
+	items := req.GetItems()
+	results := make([]s.AddResult, len(items))
+	for i, item := range items {
+		fullURL, err := ss.mw.URLs.Canonicalize(item.GetOriginalUrl())
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		expiresAt, err := expiry(item.GetExpiresAt(), item.GetTtl())
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		urls = append(urls, s.URL{FullURL: fullURL, Alias: item.GetAlias(), ExpiresAt: expiresAt})
+		positions = append(positions, i)
+	}
+
+	if req.GetAtomic() && len(urls) < len(items) {
+		for _, i := range positions {
+			results[i].Err = m.ErrRolledBack
+		}
+	} else {
+		added, err := ss.storage.AddURLs(ctx, urls, user(ctx), req.GetAtomic())
+		if err != nil {
+			log.Printf("error wile add URL to storage: %v", err)
+			return nil, status.Error(codes.Internal, "error wile add URL to storage")
+		}
+		for j, i := range positions {
+			results[i] = added[j]
+		}
+	}
+
+	resp := &pb.ShortenBatchResponse{Results: make([]*pb.BatchResult, len(items))}
+	for i, result := range results {
+		batchStatus, message := m.BatchStatus(result.Err)
+		resp.Results[i] = &pb.BatchResult{
+			CorrelationId: items[i].GetCorrelationId(),
+			ShortUrl:      result.ShortURL,
+			Status:        batchStatus,
+			Error:         message,
+		}
+	}
+	return resp, nil
+}
+
+func (ss *ShortenerServer) Expand(ctx context.Context, req *pb.ExpandRequest) (*pb.ExpandResponse, error) {
+	url, err := ss.storage.SearchURL(ctx, req.GetId())
+	switch {
+	case err == nil:
+		return &pb.ExpandResponse{OriginalUrl: url}, nil
+	case errors.Is(err, m.ErrBlockedURL):
+		return nil, status.Error(codes.PermissionDenied, "URL with this ID is blocked")
+	case errors.Is(err, m.ErrGone):
+		return nil, status.Error(codes.FailedPrecondition, "URL with this ID was deleted or expired")
+	case errors.Is(err, m.ErrNotFound):
+		return nil, status.Error(codes.NotFound, "There is no URL with this ID")
+	default:
+		log.Printf("failed to search url: %v", err)
+		return nil, status.Error(codes.Internal, "failed to search url")
+	}
+}
+
+func (ss *ShortenerServer) ListUserURLs(ctx context.Context, req *pb.ListUserURLsRequest) (*pb.ListUserURLsResponse, error) {
+	list, err := ss.storage.GetAllURLForUser(ctx, user(ctx))
+	if err != nil && !errors.Is(err, m.ErrNoContent) {
+		log.Printf("failed to list user urls: %v", err)
+		return nil, status.Error(codes.Internal, "failed to list user urls")
+	}
+
+	resp := &pb.ListUserURLsResponse{Urls: make([]*pb.UserURL, len(list))}
+	for i, url := range list {
+		resp.Urls[i] = &pb.UserURL{ShortUrl: url.ShortURL, OriginalUrl: url.OriginalURL}
+	}
+	return resp, nil
+}
+
+func (ss *ShortenerServer) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	if err := ss.storage.Ping(ctx); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.PingResponse{}, nil
+}
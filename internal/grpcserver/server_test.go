@@ -0,0 +1,140 @@
+package grpcserver
+
+import (
+	"context"
+	m "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	pb "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/proto"
+	s "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+	"time"
+)
+
+func newClient(t *testing.T, mw m.MiddlewareStruct) (pb.ShortenerClient, *s.Memory) {
+	t.Helper()
+
+	st := &s.Memory{
+		BaseURL:   "http://localhost:8080/",
+		URLID:     make(map[string]int),
+		IDURL:     make(map[int]string),
+		UserURLs:  make(map[string][]int),
+		Deleted:   make(map[int]bool),
+		Aliases:   make(map[string]int),
+		IDAlias:   make(map[int]string),
+		ExpiresAt: make(map[int]time.Time),
+		Clicks:    make(map[int]*s.ClickStats),
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	srv := New("bufconn", st, mw, nil)
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewShortenerClient(conn), st
+}
+
+func TestShortener(t *testing.T) {
+	mw := m.MiddlewareStruct{Keys: m.NewKeyRing(m.NewRandomKey()), BaseURL: "http://localhost:8080/"}
+	client, st := newClient(t, mw)
+	ctx := context.Background()
+
+	var header metadata.MD
+	resp, err := client.Shorten(ctx, &pb.ShortenRequest{Url: "https://github.com/"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/1", resp.GetShortUrl())
+	assert.False(t, resp.GetExisting())
+
+	require.Len(t, header.Get(MetadataUserID), 1)
+	require.Len(t, header.Get(MetadataUserSign), 1)
+	userID := header.Get(MetadataUserID)[0]
+	userCtx := metadata.AppendToOutgoingContext(ctx, MetadataUserID, userID, MetadataUserSign, header.Get(MetadataUserSign)[0])
+
+	header = nil
+	resp, err = client.Shorten(userCtx, &pb.ShortenRequest{Url: "https://github.com/"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.True(t, resp.GetExisting())
+	assert.Equal(t, "http://localhost:8080/1", resp.GetShortUrl())
+	assert.Empty(t, header.Get(MetadataUserID), "valid credentials must not be reissued")
+
+	_, err = client.Shorten(userCtx, &pb.ShortenRequest{Url: "https://go.dev/", Alias: "not/valid"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Shorten(userCtx, &pb.ShortenRequest{Url: "https://go.dev/", Ttl: -1})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Shorten(userCtx, &pb.ShortenRequest{Url: "javascript:alert(1)"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	batch, err := client.ShortenBatch(userCtx, &pb.ShortenBatchRequest{Items: []*pb.BatchItem{
+		{CorrelationId: "a", OriginalUrl: "https://go.dev/", Alias: "go"},
+		{CorrelationId: "b", OriginalUrl: "https://github.com/"},
+		{CorrelationId: "c", OriginalUrl: "https://www.google.ru/", Alias: "go"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, batch.GetResults(), 3)
+	assert.Equal(t, "a", batch.GetResults()[0].GetCorrelationId())
+	assert.Equal(t, m.BatchCreated, batch.GetResults()[0].GetStatus())
+	assert.Equal(t, "http://localhost:8080/go", batch.GetResults()[0].GetShortUrl())
+	assert.Equal(t, m.BatchExisting, batch.GetResults()[1].GetStatus())
+	assert.Equal(t, m.BatchInvalid, batch.GetResults()[2].GetStatus())
+
+	_, err = client.Shorten(userCtx, &pb.ShortenRequest{Url: "https://practicum.yandex.ru/", Alias: "go"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	expanded, err := client.Expand(ctx, &pb.ExpandRequest{Id: "go"})
+	require.NoError(t, err)
+	assert.Equal(t, "https://go.dev/", expanded.GetOriginalUrl())
+	_, err = client.Expand(ctx, &pb.ExpandRequest{Id: "999"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.ListUserURLs(ctx, &pb.ListUserURLsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, list.GetUrls())
+
+	list, err = client.ListUserURLs(userCtx, &pb.ListUserURLsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.GetUrls(), 2)
+	assert.Equal(t, "https://github.com/", list.GetUrls()[0].GetOriginalUrl())
+	assert.Equal(t, "https://go.dev/", list.GetUrls()[1].GetOriginalUrl())
+
+	require.NoError(t, st.DeleteURLs(ctx, userID, []string{"1"}))
+	_, err = client.Expand(ctx, &pb.ExpandRequest{Id: "1"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "deleted URLs must not look unknown")
+
+	_, err = client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestBearerToken(t *testing.T) {
+	mw := m.MiddlewareStruct{Keys: m.NewKeyRing(m.NewRandomKey()), BaseURL: "http://localhost:8080/"}
+	client, _ := newClient(t, mw)
+
+	token, err := mw.IssueToken("token-user")
+	require.NoError(t, err)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token.Token)
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "https://github.com/"})
+	require.NoError(t, err)
+
+	list, err := client.ListUserURLs(ctx, &pb.ListUserURLsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, list.GetUrls(), 1)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer broken")
+	_, err = client.ListUserURLs(ctx, &pb.ListUserURLsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
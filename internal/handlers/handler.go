@@ -5,18 +5,20 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/mux"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/metrics"
 	m "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
 	s "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
 	"io"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
+	"time"
 )
 
 type StorageHandlers struct {
 	storage s.Storage
 	mw      m.MiddlewareStruct
+	deleter *s.DeleteWorker
 }
 
 func ReadBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
@@ -65,13 +67,24 @@ func (sh StorageHandlers) PostAddURLHandler(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "failed read request", http.StatusInternalServerError)
 		return
 	}
-	url := string(urlBytes)
+	url, err := sh.mw.URLs.Canonicalize(string(urlBytes))
+	if err != nil {
+		http.Error(w, "invalid URL, it must be an absolute http(s) URL", http.StatusBadRequest)
+		return
+	}
 	user := r.Context().Value(m.UserIDKey{}).(string)
 	if user == "" {
 		user = m.GetCookie(r, m.CookieUserID)
 	}
 
-	fullShortenURL, err := sh.storage.AddURL(ctx, url, user)
+	fullShortenURL, err := sh.storage.AddURL(ctx, s.URL{FullURL: url}, user)
+	if errors.Is(err, m.ErrBlockedURL) {
+		http.Error(w, "URL is blocked", http.StatusUnprocessableEntity)
+		return
+	} else if errors.Is(err, m.ErrRedirectLoop) {
+		http.Error(w, "URL points back at the shortener", http.StatusBadRequest)
+		return
+	}
 	w.Header().Set("Content-Type", "text/html")
 
 	if err != nil {
@@ -92,11 +105,14 @@ func (sh StorageHandlers) ShortenBatchHandler(w http.ResponseWriter, r *http.Req
 	var (
 		batchRequestList  []m.JSONBatchRequest
 		batchResponseList []m.JSONBatchResponse
+		urls              []s.URL
+		positions         []int
 	)
 	user := r.Context().Value(m.UserIDKey{}).(string)
 	if user == "" {
 		user = m.GetCookie(r, m.CookieUserID)
 	}
+	atomic := r.URL.Query().Get("atomic") == "true"
 
 	urlBytes, err := ReadBody(w, r)
 	if err != nil {
@@ -108,30 +124,74 @@ func (sh StorageHandlers) ShortenBatchHandler(w http.ResponseWriter, r *http.Req
 	w.Header().Set("Content-Type", "application/json")
 
 	err = json.Unmarshal([]byte(urlBytes), &batchRequestList)
+	if err == nil {
+		sh.mw.Metrics.ObserveBatch(len(batchRequestList))
+	}
 	if err != nil {
 		log.Printf("error in JSON: %v", err)
 		http.Error(w, "error in JSON", http.StatusInternalServerError)
 		return
 	}
+
+	results := make([]s.AddResult, len(batchRequestList))
 	for i := range batchRequestList {
+		fullURL, err := sh.mw.URLs.Canonicalize(batchRequestList[i].OriginalURL)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		expiresAt, err := m.ExpiryTime(batchRequestList[i].ExpiresAt, batchRequestList[i].TTL, time.Now())
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		urls = append(urls, s.URL{
+			FullURL:   fullURL,
+			Alias:     batchRequestList[i].Alias,
+			ExpiresAt: expiresAt,
+		})
+		positions = append(positions, i)
+	}
+
+	failed := len(urls) < len(batchRequestList)
+	if atomic && failed {
+		for _, i := range positions {
+			results[i].Err = m.ErrRolledBack
+		}
+	} else {
 		ctx := r.Context()
-		fullShortenURL, err := sh.storage.AddURL(ctx, batchRequestList[i].OriginalURL, user)
-		if errors.Is(m.NewStorageError(m.ErrConflict, "409"), err) {
-			w.WriteHeader(http.StatusConflict)
-			return
-		} else if err != nil {
+		added, err := sh.storage.AddURLs(ctx, urls, user, atomic)
+		if err != nil {
 			log.Printf("error wile add URL to storage: %v", err)
 			http.Error(w, "error wile add URL to storage", http.StatusInternalServerError)
 			return
-		} else {
-			w.WriteHeader(http.StatusCreated)
 		}
+		for j, i := range positions {
+			results[i] = added[j]
+			failed = failed || added[j].Err != nil
+		}
+	}
 
-		batch := &m.JSONBatchResponse{
-			CorrelationID: batchRequestList[i].CorrelationID,
-			ShortenURL:    fullShortenURL,
+	for i, result := range results {
+		status, message := m.BatchStatus(result.Err)
+		if status == m.BatchError {
+			log.Printf("error wile add URL to storage: %v", result.Err)
 		}
-		batchResponseList = append(batchResponseList, *batch)
+		batchResponseList = append(batchResponseList, m.JSONBatchResponse{
+			CorrelationID: batchRequestList[i].CorrelationID,
+			ShortenURL:    result.ShortURL,
+			Status:        status,
+			Error:         message,
+		})
+	}
+
+	switch {
+	case !failed:
+		w.WriteHeader(http.StatusCreated)
+	case atomic:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusMultiStatus)
 	}
 	json.NewEncoder(w).Encode(batchResponseList)
 }
@@ -159,11 +219,38 @@ func (sh StorageHandlers) ShortenHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	fullURL, err := sh.mw.URLs.Canonicalize(newURLFull.URLFull)
+	if err != nil {
+		http.Error(w, "invalid URL, it must be an absolute http(s) URL", http.StatusBadRequest)
+		return
+	}
+	expiresAt, err := m.ExpiryTime(newURLFull.ExpiresAt, newURLFull.TTL, time.Now())
+	if err != nil {
+		http.Error(w, "invalid expiration", http.StatusBadRequest)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	ctx := r.Context()
-	fullShortenURL, err := sh.storage.AddURL(ctx, newURLFull.URLFull, user)
-	if err != nil {
+	fullShortenURL, err := sh.storage.AddURL(ctx, s.URL{
+		FullURL:   fullURL,
+		Alias:     newURLFull.Alias,
+		ExpiresAt: expiresAt,
+	}, user)
+	if errors.Is(err, m.ErrBlockedURL) {
+		http.Error(w, "URL is blocked", http.StatusUnprocessableEntity)
+		return
+	} else if errors.Is(err, m.ErrRedirectLoop) {
+		http.Error(w, "URL points back at the shortener", http.StatusBadRequest)
+		return
+	} else if errors.Is(m.NewStorageError(m.ErrAliasConflict, "409"), err) {
+		http.Error(w, "alias is already taken", http.StatusConflict)
+		return
+	} else if errors.Is(m.NewStorageError(m.ErrInvalidAlias, "400"), err) {
+		http.Error(w, "invalid alias", http.StatusBadRequest)
+		return
+	} else if err != nil {
 		if errors.Is(m.NewStorageError(m.ErrConflict, "409"), err) {
 			w.WriteHeader(http.StatusConflict)
 		} else {
@@ -180,18 +267,26 @@ func (sh StorageHandlers) ShortenHandler(w http.ResponseWriter, r *http.Request)
 func (sh StorageHandlers) GetURLHandler(w http.ResponseWriter, r *http.Request) {
 
 	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
 
-	if err != nil {
-		http.Error(w, "ID parameter must be Integer type", http.StatusBadRequest)
-		return
-	}
 	ctx := r.Context()
-	url, err := sh.storage.SearchURL(ctx, id)
-	if err != nil {
+	url, err := sh.storage.SearchURL(ctx, params["id"])
+	if errors.Is(err, m.ErrBlockedURL) {
+		sh.mw.Metrics.Redirect(metrics.RedirectBlocked)
+		http.Error(w, "URL with this ID is blocked", http.StatusForbidden)
+		return
+	} else if errors.Is(m.NewStorageError(m.ErrGone, "410"), err) {
+		sh.mw.Metrics.Redirect(metrics.RedirectGone)
+		http.Error(w, "URL with this ID was deleted or expired", http.StatusGone)
+		return
+	} else if err != nil {
+		sh.mw.Metrics.Redirect(metrics.RedirectMiss)
 		http.Error(w, "There is no URL with this ID", http.StatusNotFound)
 		return
 	} else {
+		sh.mw.Metrics.Redirect(metrics.RedirectHit)
+		if err := sh.storage.RecordClick(ctx, params["id"], time.Now()); err != nil {
+			log.Printf("failed to record click for %s: %v", params["id"], err)
+		}
 		w.Header().Set("Location", url)
 		w.WriteHeader(http.StatusTemporaryRedirect)
 		w.Write([]byte(url))
@@ -199,6 +294,44 @@ func (sh StorageHandlers) GetURLHandler(w http.ResponseWriter, r *http.Request)
 
 }
 
+func (sh StorageHandlers) GetURLStatsHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(m.UserIDKey{}).(string)
+	if user == "" {
+		user = m.GetCookie(r, m.CookieUserID)
+	}
+
+	ctx := r.Context()
+	stats, err := sh.storage.GetURLStats(ctx, user, mux.Vars(r)["id"])
+	if errors.Is(err, m.ErrNotFound) {
+		http.Error(w, "There is no URL with this ID", http.StatusNotFound)
+		return
+	} else if errors.Is(err, m.ErrForbidden) {
+		http.Error(w, "URL with this ID belongs to another user", http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("failed to get URL stats: %v", err)
+		http.Error(w, "failed to get URL stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (sh StorageHandlers) GetInternalStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := sh.storage.GetStats(r.Context())
+	if err != nil {
+		log.Printf("failed to get stats: %v", err)
+		http.Error(w, "failed to get stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(stats)
+}
+
 func (sh StorageHandlers) GetAllURLsHandler(w http.ResponseWriter, r *http.Request) {
 	user := r.Context().Value(m.UserIDKey{}).(string)
 	if user == "" {
@@ -222,23 +355,92 @@ func (sh StorageHandlers) GetAllURLsHandler(w http.ResponseWriter, r *http.Reque
 
 }
 
-func NewRouter(storage s.Storage, mw m.MiddlewareStruct) *mux.Router {
+func (sh StorageHandlers) DeleteURLsHandler(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+
+	user := r.Context().Value(m.UserIDKey{}).(string)
+	if user == "" {
+		user = m.GetCookie(r, m.CookieUserID)
+	}
+
+	urlBytes, err := ReadBody(w, r)
+	if err != nil {
+		log.Printf("failed read request: %v", err)
+		http.Error(w, "failed read request", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.Unmarshal(urlBytes, &ids)
+	if err != nil {
+		log.Printf("error in JSON: %v", err)
+		http.Error(w, "error in JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := sh.deleter.Push(s.DeleteTask{User: user, IDs: ids}); err != nil {
+		log.Printf("failed to queue deletion: %v", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many deletions in progress, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (sh StorageHandlers) IssueTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(m.UserIDKey{}).(string)
+	if user == "" {
+		user = m.GetCookie(r, m.CookieUserID)
+	}
+
+	token, err := sh.mw.IssueToken(user)
+	if err != nil {
+		log.Printf("failed to issue token: %v", err)
+		http.Error(w, "failed to issue token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func NewRouter(storage s.Storage, mw m.MiddlewareStruct, deleter *s.DeleteWorker) *mux.Router {
 
 	router := mux.NewRouter()
-	router.Use(mw.CheckAuth)
+	router.NotFoundHandler = mw.LogRequests(mw.Metrics.Middleware(http.NotFoundHandler()))
+	router.MethodNotAllowedHandler = mw.LogRequests(mw.Metrics.Middleware(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		})))
+	router.Use(mw.LogRequests)
+	router.Use(mw.Metrics.Middleware)
+	router.Use(m.GzipHandle)
 
 	handlers := StorageHandlers{
 		storage: storage,
 		mw:      mw,
+		deleter: deleter,
 	}
 
-	router.HandleFunc("/", handlers.PostAddURLHandler).Methods("POST")
-	router.HandleFunc("/api/shorten", handlers.ShortenHandler).Methods("POST")
-	router.HandleFunc("/api/shorten/batch", handlers.ShortenBatchHandler).Methods("POST")
+	// internal stats are scraped by trusted services, they are no users and get no cookies
+	router.Handle("/api/internal/stats", mw.TrustedOnly(http.HandlerFunc(handlers.GetInternalStatsHandler))).Methods("GET")
+
+	users := router.NewRoute().Subrouter()
+	users.Use(mw.CheckAuth)
 
-	router.HandleFunc("/ping", handlers.PingDB).Methods("GET")
-	router.HandleFunc("/{id}", handlers.GetURLHandler).Methods("GET")
-	router.HandleFunc("/api/user/urls", handlers.GetAllURLsHandler).Methods("GET")
+	limited := func(path string, handler http.HandlerFunc) http.Handler {
+		return mw.RateLimited(mw.RateLimits[path], handler)
+	}
+	users.Handle("/", limited("/", handlers.PostAddURLHandler)).Methods("POST")
+	users.Handle("/api/shorten", limited("/api/shorten", handlers.ShortenHandler)).Methods("POST")
+	users.Handle("/api/shorten/batch", limited("/api/shorten/batch", handlers.ShortenBatchHandler)).Methods("POST")
+	users.HandleFunc("/api/user/token", handlers.IssueTokenHandler).Methods("POST")
+
+	users.HandleFunc("/ping", handlers.PingDB).Methods("GET")
+	users.HandleFunc("/{id}", handlers.GetURLHandler).Methods("GET")
+	users.HandleFunc("/api/user/urls", handlers.GetAllURLsHandler).Methods("GET")
+	users.HandleFunc("/api/user/urls", handlers.DeleteURLsHandler).Methods("DELETE")
+	users.HandleFunc("/api/user/urls/{id}/stats", handlers.GetURLStatsHandler).Methods("GET")
 
 	return router
 }
@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	DefaultBuckets   = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	BatchSizeBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+)
+
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	collect func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		if f.kind == "histogram" {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type Counter struct {
+	f *family
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) Add(v float64, labels ...string) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.get(labels).value += v
+}
+
+type Histogram struct {
+	f *family
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	s := h.f.get(labels)
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// Registry keeps metric families in the order they were registered and writes them in text exposition format
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(f *family) *family {
+	f.series = make(map[string]*series)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.families {
+		if existing.name == f.name {
+			panic("metric " + f.name + " is registered twice")
+		}
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{r.register(&family{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+// NewGaugeFunc registers a gauge whose value is taken from collect on every scrape
+func (r *Registry) NewGaugeFunc(name string, help string, collect func() float64) {
+	r.register(&family{name: name, help: help, kind: "gauge", collect: collect})
+}
+
+// NewCounterFunc registers a counter whose value is taken from collect on every scrape
+func (r *Registry) NewCounterFunc(name string, help string, collect func() float64) {
+	r.register(&family{name: name, help: help, kind: "counter", collect: collect})
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, args ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
+
+func (f *family) write(cw *countingWriter) {
+	cw.printf("# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	cw.printf("# TYPE %s %s\n", f.name, f.kind)
+
+	if f.collect != nil {
+		cw.printf("%s %s\n", f.name, formatFloat(f.collect()))
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			cw.printf("%s%s %s\n", f.name, formatLabels(f.labels, s.labels), formatFloat(s.value))
+			continue
+		}
+
+		names := withLabel(f.labels, "le")
+		for i, bound := range f.buckets {
+			cw.printf("%s_bucket%s %d\n", f.name, formatLabels(names, withLabel(s.labels, formatFloat(bound))), s.buckets[i])
+		}
+		cw.printf("%s_bucket%s %d\n", f.name, formatLabels(names, withLabel(s.labels, "+Inf")), s.count)
+		cw.printf("%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labels), formatFloat(s.sum))
+		cw.printf("%s_count%s %d\n", f.name, formatLabels(f.labels, s.labels), s.count)
+	}
+}
+
+// withLabel appends to a copy, so label slices shared between series are never written to
+func withLabel(labels []string, label string) []string {
+	return append(append(make([]string, 0, len(labels)+1), labels...), label)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
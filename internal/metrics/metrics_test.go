@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests.", "route", "code")
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.5, 0.1}, "route")
+	r.NewGaugeFunc("open_conns", "Open connections.", func() float64 { return 3 })
+
+	requests.Inc("/{id}", "307")
+	requests.Add(2, "/", "201")
+	requests.Inc(`"quoted"`, "404")
+	latency.Observe(0.05, "/")
+	latency.Observe(0.3, "/")
+
+	ts := httptest.NewServer(r.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, ContentType, resp.Header.Get("Content-Type"))
+	assert.Equal(t, `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{route="\"quoted\"",code="404"} 1
+requests_total{route="/",code="201"} 2
+requests_total{route="/{id}",code="307"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/",le="0.1"} 1
+latency_seconds_bucket{route="/",le="0.5"} 2
+latency_seconds_bucket{route="/",le="+Inf"} 2
+latency_seconds_sum{route="/"} 0.35
+latency_seconds_count{route="/"} 2
+# HELP open_conns Open connections.
+# TYPE open_conns gauge
+open_conns 3
+`, string(body))
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	assert.NotNil(t, m.Middleware(handler))
+	m.Redirect(RedirectHit)
+	m.ObserveStorage("memory", "add_url", 0)
+	m.ObserveBatch(1)
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	RedirectHit     = "hit"
+	RedirectMiss    = "miss"
+	RedirectGone    = "gone"
+	RedirectBlocked = "blocked"
+
+	unmatchedRoute = "unmatched"
+)
+
+// Metrics are the metrics of the shortener, a nil *Metrics is valid and records nothing
+type Metrics struct {
+	*Registry
+
+	requests  *Counter
+	latency   *Histogram
+	redirects *Counter
+	storage   *Histogram
+	batches   *Histogram
+}
+
+func New() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		Registry: r,
+		requests: r.NewCounter("shortener_http_requests_total",
+			"HTTP requests by route, method and status code.", "route", "method", "code"),
+		latency: r.NewHistogram("shortener_http_request_duration_seconds",
+			"HTTP request latencies by route and method.", DefaultBuckets, "route", "method"),
+		redirects: r.NewCounter("shortener_redirects_total",
+			"Short URL lookups by result: hit, miss, gone or blocked.", "result"),
+		storage: r.NewHistogram("shortener_storage_operation_duration_seconds",
+			"Storage operation latencies by backend and operation.", DefaultBuckets, "backend", "operation"),
+		batches: r.NewHistogram("shortener_batch_size",
+			"Number of URLs in batch shortening requests.", BatchSizeBuckets),
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Middleware counts requests per route template of NewRouter, so IDs in paths do not blow up the label set
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		route := unmatchedRoute
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+
+		m.requests.Inc(route, r.Method, strconv.Itoa(sw.status))
+		m.latency.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+func (m *Metrics) Redirect(result string) {
+	if m != nil {
+		m.redirects.Inc(result)
+	}
+}
+
+func (m *Metrics) ObserveStorage(backend string, operation string, d time.Duration) {
+	if m != nil {
+		m.storage.Observe(d.Seconds(), backend, operation)
+	}
+}
+
+func (m *Metrics) ObserveBatch(size int) {
+	if m != nil {
+		m.batches.Observe(float64(size))
+	}
+}
+
+// WatchPool exposes pgx pool statistics, they are read from the pool on every scrape
+func (m *Metrics) WatchPool(pool *pgxpool.Pool) {
+	stats := []struct {
+		register   func(name string, help string, collect func() float64)
+		name, help string
+		value      func(s *pgxpool.Stat) float64
+	}{
+		{m.NewGaugeFunc, "pgxpool_acquired_conns", "Connections currently acquired from the pool.",
+			func(s *pgxpool.Stat) float64 { return float64(s.AcquiredConns()) }},
+		{m.NewGaugeFunc, "pgxpool_idle_conns", "Idle connections in the pool.",
+			func(s *pgxpool.Stat) float64 { return float64(s.IdleConns()) }},
+		{m.NewGaugeFunc, "pgxpool_total_conns", "Total connections in the pool.",
+			func(s *pgxpool.Stat) float64 { return float64(s.TotalConns()) }},
+		{m.NewGaugeFunc, "pgxpool_max_conns", "Maximum size of the pool.",
+			func(s *pgxpool.Stat) float64 { return float64(s.MaxConns()) }},
+		{m.NewCounterFunc, "pgxpool_acquire_total", "Successful acquires from the pool.",
+			func(s *pgxpool.Stat) float64 { return float64(s.AcquireCount()) }},
+		{m.NewCounterFunc, "pgxpool_empty_acquire_total", "Acquires that waited because the pool was empty.",
+			func(s *pgxpool.Stat) float64 { return float64(s.EmptyAcquireCount()) }},
+		{m.NewCounterFunc, "pgxpool_canceled_acquire_total", "Acquires canceled by their context.",
+			func(s *pgxpool.Stat) float64 { return float64(s.CanceledAcquireCount()) }},
+		{m.NewCounterFunc, "pgxpool_acquire_duration_seconds_total", "Total time spent acquiring connections.",
+			func(s *pgxpool.Stat) float64 { return s.AcquireDuration().Seconds() }},
+	}
+	for _, stat := range stats {
+		value := stat.value
+		stat.register(stat.name, stat.help, func() float64 { return value(pool.Stat()) })
+	}
+}
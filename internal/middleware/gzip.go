@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+const gzipMinLength = 1024
+
+var compressibleTypes = []string{"application/json", "text/"}
+
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	buf     []byte
+	status  int
+	decided bool
+}
+
+func (w *gzipWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= gzipMinLength {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *gzipWriter) shouldCompress() bool {
+	if w.status >= 300 && w.status < 400 || w.status == http.StatusNoContent {
+		return false
+	}
+	if len(w.buf) < gzipMinLength || w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *gzipWriter) decide() error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if w.shouldCompress() {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+		_, err := w.gz.Write(w.buf)
+		return err
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) > 0 {
+		_, err := w.ResponseWriter.Write(w.buf)
+		return err
+	}
+	return nil
+}
+
+func (w *gzipWriter) Close() error {
+	if !w.decided {
+		return w.decide()
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+func GzipHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+
+		next.ServeHTTP(gw, r)
+	})
+}
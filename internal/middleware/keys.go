@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const keyIDSeparator = "."
+
+var (
+	ErrNoActiveKey = errors.New("there is no active signing key")
+	ErrNoKeyFile   = errors.New("signing keys are not backed by a key file")
+)
+
+type SigningKey struct {
+	ID     string
+	Secret []byte
+	Active bool
+}
+
+type JSONSigningKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	Active bool   `json:"active"`
+}
+
+type KeyRing struct {
+	mu   sync.RWMutex
+	path string
+	keys []SigningKey
+}
+
+func NewKeyRing(keys ...SigningKey) *KeyRing {
+	return &KeyRing{keys: keys}
+}
+
+func NewRandomKey() SigningKey {
+	return SigningKey{
+		ID:     hex.EncodeToString(GenerateRandom(4)),
+		Secret: GenerateRandom(32),
+		Active: true,
+	}
+}
+
+func ParseKeys(value string) ([]SigningKey, error) {
+	var keys []SigningKey
+
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("signing key must be in a form id:hexsecret, got %q", item)
+		}
+		key, err := newKey(JSONSigningKey{ID: parts[0], Secret: parts[1], Active: true})
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func LoadKeyRing(path string) (*KeyRing, error) {
+	kr := &KeyRing{path: path}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		kr.keys = []SigningKey{NewRandomKey()}
+		return kr, kr.save()
+	}
+	return kr, kr.Reload()
+}
+
+func newKey(jk JSONSigningKey) (SigningKey, error) {
+	if strings.Contains(jk.ID, keyIDSeparator) {
+		return SigningKey{}, fmt.Errorf("signing key id %q must not contain %q", jk.ID, keyIDSeparator)
+	}
+	secret, err := hex.DecodeString(jk.Secret)
+	if err != nil || len(secret) == 0 {
+		return SigningKey{}, fmt.Errorf("signing key %q must have a non-empty hex secret", jk.ID)
+	}
+	return SigningKey{ID: jk.ID, Secret: secret, Active: jk.Active}, nil
+}
+
+func (kr *KeyRing) Reload() error {
+	var (
+		jsonKeys []JSONSigningKey
+		keys     []SigningKey
+	)
+
+	if kr.path == "" {
+		return ErrNoKeyFile
+	}
+
+	data, err := os.ReadFile(kr.path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &jsonKeys); err != nil {
+		return fmt.Errorf("failed to parse key file %s: %w", kr.path, err)
+	}
+
+	for _, jk := range jsonKeys {
+		key, err := newKey(jk)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if !hasActive(keys) {
+		return ErrNoActiveKey
+	}
+	kr.keys = keys
+	return nil
+}
+
+// Rotate starts signing with a new key, it is refused without a key file,
+// since the new key would be lost on restart with everything signed by it
+func (kr *KeyRing) Rotate() (SigningKey, error) {
+	if kr.path == "" {
+		return SigningKey{}, ErrNoKeyFile
+	}
+	key := NewRandomKey()
+
+	kr.mu.Lock()
+	kr.keys = append(kr.keys, key)
+	kr.mu.Unlock()
+
+	if err := kr.save(); err != nil {
+		kr.mu.Lock()
+		kr.keys = kr.keys[:len(kr.keys)-1]
+		kr.mu.Unlock()
+		return SigningKey{}, err
+	}
+	return key, nil
+}
+
+func (kr *KeyRing) save() error {
+	if kr.path == "" {
+		return ErrNoKeyFile
+	}
+
+	kr.mu.RLock()
+	jsonKeys := make([]JSONSigningKey, 0, len(kr.keys))
+	for _, key := range kr.keys {
+		jsonKeys = append(jsonKeys, JSONSigningKey{
+			ID:     key.ID,
+			Secret: hex.EncodeToString(key.Secret),
+			Active: key.Active,
+		})
+	}
+	kr.mu.RUnlock()
+
+	data, err := json.MarshalIndent(jsonKeys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(kr.path, data, 0600)
+}
+
+func hasActive(keys []SigningKey) bool {
+	for _, key := range keys {
+		if key.Active {
+			return true
+		}
+	}
+	return false
+}
+
+func (kr *KeyRing) Current() (SigningKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		if kr.keys[i].Active {
+			return kr.keys[i], nil
+		}
+	}
+	return SigningKey{}, ErrNoActiveKey
+}
+
+func (kr *KeyRing) Lookup(id string) (SigningKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	for _, key := range kr.keys {
+		if key.ID == id && key.Active {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func (kr *KeyRing) Sign(userID string) (string, error) {
+	key, err := kr.Current()
+	if err != nil {
+		return "", err
+	}
+	return key.ID + keyIDSeparator + fmt.Sprintf("%x", SetSign(userID, key.Secret)), nil
+}
+
+func (kr *KeyRing) Verify(userID string, sign string) (string, bool) {
+	parts := strings.SplitN(sign, keyIDSeparator, 2)
+	if userID == "" || len(parts) != 2 {
+		return "", false
+	}
+
+	key, found := kr.Lookup(parts[0])
+	if !found {
+		return "", false
+	}
+
+	signBytes, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	return key.ID, hmac.Equal(signBytes, SetSign(userID, key.Secret))
+}
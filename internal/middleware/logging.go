@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gofrs/uuid"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	HeaderRequestID = "X-Request-ID"
+
+	maxRequestIDLength = 128
+)
+
+var accessLog = log.New(os.Stderr, "", 0)
+
+type RequestIDKey struct{}
+
+type accessRecordKey struct{}
+
+type AccessRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	Bytes     int       `json:"bytes"`
+	LatencyMs float64   `json:"latency_ms"`
+	UserID    string    `json:"user_id,omitempty"`
+}
+
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *loggingWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *loggingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(RequestIDKey{}).(string)
+	return id
+}
+
+// validRequestID keeps client supplied IDs from breaking log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// setLoggedUser lets the auth middleware, which runs inside LogRequests, report the user of the request
+func setLoggedUser(ctx context.Context, userID string) {
+	if record, ok := ctx.Value(accessRecordKey{}).(*AccessRecord); ok {
+		record.UserID = userID
+	}
+}
+
+func (s *MiddlewareStruct) LogRequests(next http.Handler) http.Handler {
+	logger := s.Logger
+	if logger == nil {
+		logger = accessLog
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(HeaderRequestID)
+		if !validRequestID(requestID) {
+			u, _ := uuid.NewV4()
+			requestID = u.String()
+		}
+		w.Header().Set(HeaderRequestID, requestID)
+
+		record := &AccessRecord{
+			RequestID: requestID,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+		}
+		ctx := context.WithValue(r.Context(), RequestIDKey{}, requestID)
+		ctx = context.WithValue(ctx, accessRecordKey{}, record)
+
+		lw := &loggingWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r.WithContext(ctx))
+
+		record.Time = start.UTC()
+		record.Status = lw.status
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		record.Bytes = lw.bytes
+		record.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+		data, err := json.Marshal(record)
+		if err != nil {
+			log.Printf("failed to encode access record: %v", err)
+			return
+		}
+		logger.Println(string(data))
+	})
+}
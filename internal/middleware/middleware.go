@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
 	"crypto/hmac"
 	"crypto/rand"
@@ -9,9 +10,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gofrs/uuid"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/metrics"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"time"
 )
 
 const (
@@ -20,21 +25,41 @@ const (
 )
 
 var (
-	ErrConflict  = errors.New(`409 Conflict`)
-	ErrNoContent = errors.New(`204 No Content`)
-	SecretKey    = GenerateRandom(16)
+	ErrConflict      = errors.New(`409 Conflict`)
+	ErrNoContent     = errors.New(`204 No Content`)
+	ErrGone          = errors.New(`410 Gone`)
+	ErrAliasConflict = errors.New(`409 Alias Conflict`)
+	ErrInvalidAlias  = errors.New(`400 Invalid Alias`)
+	ErrInvalidExpiry = errors.New(`400 Invalid Expiry`)
+	ErrNotFound      = errors.New(`404 Not Found`)
+	ErrForbidden     = errors.New(`403 Forbidden`)
+	ErrCorruptFile   = errors.New("storage file is corrupt")
+	ErrRolledBack    = errors.New("rolled back with the rest of the batch")
+	ErrQueueFull     = errors.New(`503 Queue Full`)
 )
 
 type UserIDKey struct{}
 
+// NewUserKey marks requests of users made up by CheckAuth, they came without valid credentials
+type NewUserKey struct{}
+
 type SignInStruct struct {
 	UserID string `json:"user_id"`
 }
 
 type MiddlewareStruct struct {
-	SecretKey []byte
-	BaseURL   string
-	Server    string
+	Keys     *KeyRing
+	TokenTTL time.Duration
+	BaseURL  string
+	Server   string
+	Secure   bool
+	Logger   *log.Logger
+	Metrics  *metrics.Metrics
+
+	URLs          URLPolicy
+	TrustedSubnet *net.IPNet
+	// RateLimits are keyed by route path, routes without a limit are not limited
+	RateLimits map[string]RateLimit
 }
 
 type JSONStructForAuth struct {
@@ -43,13 +68,46 @@ type JSONStructForAuth struct {
 }
 
 type JSONStruct struct {
-	FullURL    string `json:"fullURL"`
-	ShortenURL int    `json:"shortenURL"`
-	User       string `json:"user"`
+	FullURL    string     `json:"fullURL"`
+	ShortenURL int        `json:"shortenURL"`
+	User       string     `json:"user"`
+	Deleted    bool       `json:"deleted,omitempty"`
+	Alias      string     `json:"alias,omitempty"`
+	CodeKind   string     `json:"codeKind,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+}
+
+// JSONClick stands for Clicks clicks on the day of At, At being the last of them,
+// records written before clicks were aggregated have no Clicks and stand for one click
+type JSONClick struct {
+	ShortenURL int       `json:"shortenURL"`
+	At         time.Time `json:"at"`
+	Clicks     int64     `json:"clicks,omitempty"`
+}
+
+type JSONDailyClicks struct {
+	Date   string `json:"date"`
+	Clicks int64  `json:"clicks"`
+}
+
+type JSONURLStats struct {
+	ShortURL     string            `json:"short_url"`
+	OriginalURL  string            `json:"original_url"`
+	Clicks       int64             `json:"clicks"`
+	LastAccessed *time.Time        `json:"last_accessed,omitempty"`
+	Daily        []JSONDailyClicks `json:"daily"`
+}
+
+type JSONInternalStats struct {
+	URLs  int `json:"urls"`
+	Users int `json:"users"`
 }
 
 type URLFull struct {
-	URLFull string `json:"url"`
+	URLFull   string     `json:"url"`
+	Alias     string     `json:"alias,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	TTL       int64      `json:"ttl,omitempty"`
 }
 
 type URLShorten struct {
@@ -57,13 +115,53 @@ type URLShorten struct {
 }
 
 type JSONBatchRequest struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string     `json:"correlation_id"`
+	OriginalURL   string     `json:"original_url"`
+	Alias         string     `json:"alias,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	TTL           int64      `json:"ttl,omitempty"`
+}
+
+const (
+	BatchCreated    = "created"
+	BatchExisting   = "existing"
+	BatchInvalid    = "invalid"
+	BatchError      = "error"
+	BatchRolledBack = "rolled_back"
+	BatchBlocked    = "blocked"
+)
+
+// BatchStatus tells the status and the error message of a batch item added with err
+func BatchStatus(err error) (string, string) {
+	switch {
+	case err == nil:
+		return BatchCreated, ""
+	case errors.Is(err, ErrConflict):
+		return BatchExisting, ""
+	case errors.Is(err, ErrAliasConflict):
+		return BatchInvalid, "alias is already taken"
+	case errors.Is(err, ErrBlockedURL):
+		return BatchBlocked, "URL is blocked"
+	case errors.Is(err, ErrRedirectLoop):
+		return BatchInvalid, "URL points back at the shortener"
+	case errors.Is(err, ErrInvalidURL):
+		return BatchInvalid, "invalid URL"
+	case errors.Is(err, ErrInvalidAlias):
+		return BatchInvalid, "invalid alias"
+	case errors.Is(err, ErrInvalidExpiry):
+		return BatchInvalid, "invalid expiration"
+	case errors.Is(err, ErrRolledBack):
+		return BatchRolledBack, err.Error()
+	default:
+		return BatchError, "error wile add URL to storage"
+	}
 }
 
 type JSONBatchResponse struct {
 	CorrelationID string `json:"correlation_id"`
-	ShortenURL    string `json:"short_url"`
+	ShortenURL    string `json:"short_url,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
 }
 
 func GenerateRandom(size int) []byte {
@@ -98,22 +196,109 @@ func CreateFile(filePath string) {
 	defer f.Close()
 }
 
-func InitMapByJSON(filePath string) []JSONStruct {
+type SkippedRecord struct {
+	Line   int
+	Reason string
+}
+
+type journalReader struct {
+	recovery bool
+	skipped  []SkippedRecord
+}
+
+func (jr *journalReader) skip(line int, reason error) error {
+	if !jr.recovery {
+		return fmt.Errorf("%w: record %d: %v", ErrCorruptFile, line, reason)
+	}
+	jr.skipped = append(jr.skipped, SkippedRecord{Line: line, Reason: reason.Error()})
+	return nil
+}
+
+func InitMapByJSON(filePath string, recovery bool) ([]JSONStruct, []SkippedRecord, error) {
 	jsonString, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
+	jr := &journalReader{recovery: recovery}
 	targets := []JSONStruct{}
 
-	err = json.Unmarshal(jsonString, &targets)
-	if err != nil {
-		log.Fatal(err)
+	trimmed := bytes.TrimSpace(jsonString)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		targets, err = jr.readArray(trimmed)
+		return targets, jr.skipped, err
+	}
+
+	// journal is replayed in order, a later record of the same URL supersedes the earlier one
+	positions := make(map[int]int)
+	lines := bytes.Split(jsonString, []byte("\n"))
+	for i, line := range lines {
+		var t JSONStruct
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		err := json.Unmarshal(line, &t)
+		if err == nil {
+			err = validRecord(t)
+		}
+		if err != nil && i == len(lines)-1 {
+			// a write interrupted by a crash leaves an unterminated last line, it is dropped even without recovery
+			jr.skipped = append(jr.skipped, SkippedRecord{Line: i + 1, Reason: "unterminated last record: " + err.Error()})
+			continue
+		} else if err != nil {
+			if err := jr.skip(i+1, err); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		if i, found := positions[t.ShortenURL]; found {
+			targets[i] = t
+			continue
+		}
+		positions[t.ShortenURL] = len(targets)
+		targets = append(targets, t)
 	}
-	return targets
+	return targets, jr.skipped, nil
 
 }
 
+func (jr *journalReader) readArray(jsonString []byte) ([]JSONStruct, error) {
+	targets := []JSONStruct{}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonString))
+	if _, err := decoder.Token(); err != nil {
+		return targets, jr.skip(1, err)
+	}
+	for record := 1; decoder.More(); record++ {
+		var t JSONStruct
+
+		err := decoder.Decode(&t)
+		if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+			// the decoder can not resynchronize after a syntax error, so the rest of the array is lost
+			return targets, jr.skip(record, fmt.Errorf("%v, the rest of the file is dropped", err))
+		} else if err == nil {
+			err = validRecord(t)
+		}
+		if err != nil {
+			if err := jr.skip(record, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+func validRecord(t JSONStruct) error {
+	if t.ShortenURL <= 0 || t.FullURL == "" {
+		return errors.New("record has no URL or ID")
+	}
+	return nil
+}
+
 type StorageError struct {
 	Label string
 	Err   error
@@ -131,44 +316,97 @@ func NewStorageError(err error, label string) error {
 	return &StorageError{Err: err, Label: label}
 }
 
+func (s *MiddlewareStruct) setAuthCookies(w http.ResponseWriter, userID string) error {
+	userSign, err := s.Keys.Sign(userID)
+	if err != nil {
+		return err
+	}
+
+	cookieSign := &http.Cookie{
+		Name:   CookieUserSign,
+		Value:  userSign,
+		Path:   "/",
+		Secure: s.Secure,
+	}
+	cookieUserID := &http.Cookie{
+		Name:   CookieUserID,
+		Value:  userID,
+		Path:   "/",
+		Secure: s.Secure,
+	}
+	http.SetCookie(w, cookieSign)
+	http.SetCookie(w, cookieUserID)
+	return nil
+}
+
+// Identify checks a signed user ID, a new user is made up when the signature is invalid,
+// renew tells that the user must get credentials signed with the current key
+func (s *MiddlewareStruct) Identify(userID string, sign string) (string, bool) {
+	keyID, valid := s.Keys.Verify(userID, sign)
+	if !valid {
+		u, _ := uuid.NewV4()
+		userID = u.String()
+	}
+
+	current, _ := s.Keys.Current()
+	return userID, !valid || keyID != current.ID
+}
+
 func (s *MiddlewareStruct) CheckAuth(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		reqUserID := GetCookie(r, CookieUserID)
-		reqUserSign := GetCookie(r, CookieUserSign)
-
-		var (
-			UserID   string
-			UserSign []byte
-		)
-
-		if reqUserID == "" || reqUserSign == "" ||
-			(reqUserID != "" && reqUserSign != "" &&
-				reqUserSign != fmt.Sprintf("%x", SetSign(reqUserID, SecretKey))) {
-			u, _ := uuid.NewV4()
-			UserID = u.String()
-			UserSign = SetSign(UserID, SecretKey)
-
-			cookieSign := &http.Cookie{
-				Name:  CookieUserSign,
-				Value: fmt.Sprintf("%x", UserSign),
-				Path:  "/",
+		if tokenString, found := bearerToken(r); found {
+			userID, err := s.ParseToken(tokenString)
+			if err != nil {
+				log.Printf("failed to authorize by token: %v", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
 			}
-			cookieUserID := &http.Cookie{
-				Name:  CookieUserID,
-				Value: UserID,
-				Path:  "/",
+
+			setLoggedUser(r.Context(), userID)
+			ctx := context.WithValue(r.Context(), UserIDKey{}, userID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		UserID, renew := s.Identify(GetCookie(r, CookieUserID), GetCookie(r, CookieUserSign))
+		if renew {
+			if err := s.setAuthCookies(w, UserID); err != nil {
+				log.Printf("failed to sign user cookie: %v", err)
+				http.Error(w, "failed to sign user cookie", http.StatusInternalServerError)
+				return
 			}
-			http.SetCookie(w, cookieSign)
-			http.SetCookie(w, cookieUserID)
 		}
 
+		setLoggedUser(r.Context(), UserID)
 		ctx := context.WithValue(r.Context(), UserIDKey{}, UserID)
+		if UserID != GetCookie(r, CookieUserID) {
+			ctx = context.WithValue(ctx, NewUserKey{}, true)
+		}
 
 		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
 	})
 }
 
-//type RequestIDKey struct{}
+// maxTTL is the longest ttl in seconds that still fits in time.Duration
+const maxTTL = math.MaxInt64 / int64(time.Second)
+
+func ExpiryTime(expiresAt *time.Time, ttl int64, now time.Time) (time.Time, error) {
+	switch {
+	case expiresAt != nil && ttl != 0:
+		return time.Time{}, ErrInvalidExpiry
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return time.Time{}, ErrInvalidExpiry
+		}
+		return *expiresAt, nil
+	case ttl < 0 || ttl > maxTTL:
+		return time.Time{}, ErrInvalidExpiry
+	case ttl > 0:
+		return now.Add(time.Duration(ttl) * time.Second), nil
+	}
+	return time.Time{}, nil
+}
@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+var ErrInvalidRateLimit = errors.New("invalid rate limit")
+
+// RateLimit lets Burst requests through at once and refills them at Rate per second, a zero RateLimit is unlimited
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit reads limits like "10/s", "100/m" or "100/5m:20", the burst is the count per period if omitted
+func ParseRateLimit(spec string) (RateLimit, error) {
+	if spec == "" {
+		return RateLimit{}, nil
+	}
+
+	rate, burst, hasBurst := strings.Cut(spec, ":")
+	count, period, found := strings.Cut(rate, "/")
+	if !found {
+		return RateLimit{}, fmt.Errorf("%w %q: must be in a form count/period[:burst]", ErrInvalidRateLimit, spec)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("%w %q: count must be a positive number", ErrInvalidRateLimit, spec)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("%w %q: period must be a positive duration", ErrInvalidRateLimit, spec)
+	}
+
+	limit := RateLimit{Rate: float64(n) / d.Seconds(), Burst: n}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return RateLimit{}, fmt.Errorf("%w %q: burst must be a positive number", ErrInvalidRateLimit, spec)
+		}
+	}
+	return limit, nil
+}
+
+func (l RateLimit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per key, buckets that have refilled are dropped
+// since a full bucket lets through exactly what a missing one does
+type RateLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+func (rl *RateLimiter) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(rl.limit.Burst), b.tokens+elapsed*rl.limit.Rate)
+		b.last = now
+	}
+}
+
+// Allow takes a token from the bucket of key, when there is none it reports how long to wait for one
+func (rl *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) >= sweepInterval {
+		rl.sweep(now)
+	}
+
+	b, found := rl.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(rl.limit.Burst), last: now}
+		rl.buckets[key] = b
+	}
+	rl.refill(b, now)
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (rl *RateLimiter) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		rl.refill(b, now)
+		if b.tokens >= float64(rl.limit.Burst) {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// clientIP takes the client address from the peer, X-Real-IP is honored only when the peer
+// is a proxy inside TrustedSubnet, since anyone else can put any address there
+func (s *MiddlewareStruct) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if peer := net.ParseIP(host); peer == nil || s.TrustedSubnet == nil || !s.TrustedSubnet.Contains(peer) {
+		return host
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get(HeaderRealIP))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// RateLimited limits next by the user identified by CheckAuth and by client IP separately,
+// so neither dropping cookies nor spreading requests over addresses gets around it,
+// users made up for the request are limited by IP only since they never come again
+func (s *MiddlewareStruct) RateLimited(limit RateLimit, next http.Handler) http.Handler {
+	if limit.Unlimited() {
+		return next
+	}
+
+	byUser, byIP := NewRateLimiter(limit), NewRateLimiter(limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		allowed, wait := byIP.Allow(s.clientIP(r), now)
+		user, _ := r.Context().Value(UserIDKey{}).(string)
+		if newUser, _ := r.Context().Value(NewUserKey{}).(bool); allowed && user != "" && !newUser {
+			allowed, wait = byUser.Allow(user, now)
+		}
+
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests, retry later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTokenTTL = 24 * time.Hour
+	bearerPrefix    = "Bearer "
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type JSONToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (s *MiddlewareStruct) tokenTTL() time.Duration {
+	if s.TokenTTL <= 0 {
+		return DefaultTokenTTL
+	}
+	return s.TokenTTL
+}
+
+func (s *MiddlewareStruct) IssueToken(userID string) (JSONToken, error) {
+	key, err := s.Keys.Current()
+	if err != nil {
+		return JSONToken{}, err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(s.tokenTTL())
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{
+		Subject:   userID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	token.Header["kid"] = key.ID
+
+	signed, err := token.SignedString(key.Secret)
+	if err != nil {
+		return JSONToken{}, err
+	}
+	return JSONToken{Token: signed, ExpiresAt: time.Unix(expiresAt.Unix(), 0).UTC()}, nil
+}
+
+func (s *MiddlewareStruct) ParseToken(tokenString string) (string, error) {
+	claims := &jwt.StandardClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		keyID, _ := t.Header["kid"].(string)
+		key, found := s.Keys.Lookup(keyID)
+		if !found {
+			return nil, fmt.Errorf("unknown signing key %q", keyID)
+		}
+		return key.Secret, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if claims.Subject == "" || claims.ExpiresAt == 0 {
+		return "", fmt.Errorf("%w: subject and expiry are required", ErrInvalidToken)
+	}
+	return claims.Subject, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	return BearerToken(r.Header.Get("Authorization"))
+}
+
+// BearerToken takes the token out of an Authorization value
+func BearerToken(auth string) (string, bool) {
+	if len(auth) < len(bearerPrefix) || !strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(bearerPrefix):]), true
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const HeaderRealIP = "X-Real-IP"
+
+// Trusted tells if the X-Real-IP of the request is inside TrustedSubnet, nothing is trusted without a subnet
+func (s *MiddlewareStruct) Trusted(r *http.Request) bool {
+	if s.TrustedSubnet == nil {
+		return false
+	}
+	ip := net.ParseIP(strings.TrimSpace(r.Header.Get(HeaderRealIP)))
+	return ip != nil && s.TrustedSubnet.Contains(ip)
+}
+
+func (s *MiddlewareStruct) TrustedOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Trusted(r) {
+			http.Error(w, "Access is allowed from the trusted subnet only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidURL   = errors.New(`400 Invalid URL`)
+	ErrBlockedURL   = errors.New(`422 Blocked URL`)
+	ErrRedirectLoop = errors.New(`400 Redirect Loop`)
+)
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// hostProfile is idna.Lookup without STD3 rules, real hosts have underscores and leading hyphens in labels
+var hostProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false), idna.CheckHyphens(false))
+
+// URLChecker tells if a URL is safe to be shortened and redirected to, it returns an error wrapping
+// ErrBlockedURL for the unsafe ones, urls are passed in the form URLPolicy.Canonicalize writes them
+type URLChecker interface {
+	CheckURL(ctx context.Context, url string) error
+}
+
+// URLPolicy decides which URLs are accepted for shortening and how they are written down,
+// so equivalent spellings of a URL end up as one stored URL
+type URLPolicy struct {
+	// StripTrailingSlash drops the trailing slash of paths other than the root one
+	StripTrailingSlash bool
+}
+
+// Canonicalize accepts absolute http(s) URLs only, it lowercases the host, converts IDN hosts to punycode,
+// drops the default port and gives an empty path the root one
+func (p URLPolicy) Canonicalize(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+
+	defaultPort, supported := defaultPorts[u.Scheme]
+	if !supported {
+		return "", fmt.Errorf("%w: scheme must be http or https", ErrInvalidURL)
+	} else if u.Opaque != "" || u.Host == "" {
+		return "", fmt.Errorf("%w: URL must be absolute", ErrInvalidURL)
+	}
+
+	host, err := CanonicalHost(u.Hostname())
+	if err != nil {
+		return "", err
+	}
+
+	port := u.Port()
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return "", fmt.Errorf("%w: invalid port %q", ErrInvalidURL, port)
+		}
+	}
+	if port == "" || port == defaultPort {
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		u.Host = host
+	} else {
+		u.Host = net.JoinHostPort(host, port)
+	}
+
+	if u.Path == "" {
+		u.Path, u.RawPath = "/", ""
+	} else if p.StripTrailingSlash && u.Path != "/" && strings.HasSuffix(u.Path, "/") {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+		if u.Path == "" {
+			u.Path, u.RawPath = "/", ""
+		}
+	}
+	return u.String(), nil
+}
+
+// CanonicalHost is the host as Canonicalize writes it: lowercase, IDN in punycode
+func CanonicalHost(host string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("%w: URL must have a host", ErrInvalidURL)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	ascii, err := hostProfile.ToASCII(host)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid host %q: %v", ErrInvalidURL, host, err)
+	}
+	return strings.ToLower(ascii), nil
+}
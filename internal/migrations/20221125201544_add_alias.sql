@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+-- +goose StatementEnd
+ALTER TABLE public.storage ADD COLUMN IF NOT EXISTS alias text NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS storage_alias_idx ON public.storage USING btree (alias);
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+-- +goose StatementEnd
+DROP INDEX IF EXISTS storage_alias_idx;
+ALTER TABLE public.storage DROP COLUMN IF EXISTS alias;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+-- +goose StatementEnd
+ALTER TABLE public.storage ADD COLUMN IF NOT EXISTS code_kind text NULL;
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+-- +goose StatementEnd
+ALTER TABLE public.storage DROP COLUMN IF EXISTS code_kind;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+-- +goose StatementEnd
+ALTER TABLE public.storage ADD COLUMN IF NOT EXISTS expires_at timestamptz NULL;
+CREATE INDEX IF NOT EXISTS storage_expires_at_idx ON public.storage USING btree (expires_at) WHERE NOT is_deleted;
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+-- +goose StatementEnd
+DROP INDEX IF EXISTS storage_expires_at_idx;
+ALTER TABLE public.storage DROP COLUMN IF EXISTS expires_at;
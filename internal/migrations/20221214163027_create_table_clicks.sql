@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+SELECT 'up SQL query';
+-- +goose StatementEnd
+CREATE TABLE IF NOT EXISTS public.clicks (
+	url_id integer NOT NULL REFERENCES public.storage (id) ON DELETE CASCADE ON UPDATE CASCADE,
+	day date NOT NULL,
+	total bigint NOT NULL DEFAULT 0,
+	last_accessed timestamptz NOT NULL,
+	PRIMARY KEY (url_id, day)
+);
+-- +goose Down
+-- +goose StatementBegin
+SELECT 'down SQL query';
+-- +goose StatementEnd
+DROP TABLE IF EXISTS public.clicks;
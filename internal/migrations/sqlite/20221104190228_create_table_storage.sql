@@ -0,0 +1,9 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS storage (
+                         id INTEGER PRIMARY KEY,
+                         full_url text,
+                         user_id text NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS index_name ON storage (full_url);
+-- +goose Down
+DROP TABLE IF EXISTS storage;
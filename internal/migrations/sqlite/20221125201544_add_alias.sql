@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE storage ADD COLUMN alias text NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS storage_alias_idx ON storage (alias);
+-- +goose Down
+DROP INDEX IF EXISTS storage_alias_idx;
+ALTER TABLE storage DROP COLUMN alias;
@@ -0,0 +1,4 @@
+-- +goose Up
+ALTER TABLE storage ADD COLUMN code_kind text NULL;
+-- +goose Down
+ALTER TABLE storage DROP COLUMN code_kind;
@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE storage ADD COLUMN expires_at timestamp NULL;
+CREATE INDEX IF NOT EXISTS storage_expires_at_idx ON storage (expires_at) WHERE NOT is_deleted;
+-- +goose Down
+DROP INDEX IF EXISTS storage_expires_at_idx;
+ALTER TABLE storage DROP COLUMN expires_at;
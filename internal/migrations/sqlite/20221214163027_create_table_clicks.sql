@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS clicks (
+	url_id integer NOT NULL REFERENCES storage (id) ON DELETE CASCADE ON UPDATE CASCADE,
+	day text NOT NULL,
+	total integer NOT NULL DEFAULT 0,
+	last_accessed timestamp NOT NULL,
+	PRIMARY KEY (url_id, day)
+);
+-- +goose Down
+DROP TABLE IF EXISTS clicks;
@@ -0,0 +1,201 @@
+package shortcode
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	KindNumeric = "numeric"
+	KindBase62  = "base62"
+
+	DefaultAlphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	// obfuscation is a bijection on 40-bit numbers, so obfuscated IDs must stay below 2^40
+	obfuscatedBits = 40
+	obfuscatedMask = 1<<obfuscatedBits - 1
+	multiplier     = 0x9E3779B97F4A7C15 & obfuscatedMask
+)
+
+var (
+	ErrInvalidCode = errors.New("invalid short code")
+	urlSafe        = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-._~"
+)
+
+type Generator interface {
+	Kind() string
+	Encode(id int) string
+	Decode(code string) (int, error)
+}
+
+// Set makes new codes with Generator and keeps the generators of the other kinds,
+// so records stored before the kind was switched keep their short URLs
+type Set struct {
+	Generator
+	others []Generator
+}
+
+// Of is the generator of kind, nil if the kind is not configured
+func (s *Set) Of(kind string) Generator {
+	if s.Kind() == kind {
+		return s.Generator
+	}
+	for _, other := range s.others {
+		if other.Kind() == kind {
+			return other
+		}
+	}
+	return nil
+}
+
+// New returns a *Set, base62 codes stay resolvable after switching to numeric ones as long as their settings are kept
+func New(kind string, alphabet string, minLength int, key uint64) (Generator, error) {
+	base62, err := NewBase62(alphabet, minLength, key)
+
+	switch kind {
+	case "", KindNumeric:
+		if err != nil {
+			return &Set{Generator: Numeric{}}, nil
+		}
+		return &Set{Generator: Numeric{}, others: []Generator{base62}}, nil
+	case KindBase62:
+		if err != nil {
+			return nil, err
+		}
+		return &Set{Generator: base62, others: []Generator{Numeric{}}}, nil
+	default:
+		return nil, fmt.Errorf("unknown short code kind %q, expected %s or %s", kind, KindNumeric, KindBase62)
+	}
+}
+
+type Numeric struct{}
+
+func (Numeric) Kind() string {
+	return KindNumeric
+}
+
+func (Numeric) Encode(id int) string {
+	return strconv.Itoa(id)
+}
+
+func (Numeric) Decode(code string) (int, error) {
+	id, err := strconv.Atoi(code)
+	if err != nil || id <= 0 {
+		return 0, ErrInvalidCode
+	}
+	return id, nil
+}
+
+type Base62 struct {
+	alphabet  string
+	index     map[byte]uint64
+	minLength int
+	key       uint64
+	inverse   uint64
+}
+
+func NewBase62(alphabet string, minLength int, key uint64) (*Base62, error) {
+	if alphabet == "" {
+		alphabet = DefaultAlphabet
+	}
+	if len(alphabet) < 2 {
+		return nil, errors.New("alphabet must contain at least two characters")
+	}
+	if minLength < 0 {
+		return nil, errors.New("minimal length of short code must not be negative")
+	}
+
+	index := make(map[byte]uint64, len(alphabet))
+	for i := 0; i < len(alphabet); i++ {
+		if !strings.ContainsRune(urlSafe, rune(alphabet[i])) {
+			return nil, fmt.Errorf("alphabet character %q is not URL safe", alphabet[i])
+		}
+		if _, found := index[alphabet[i]]; found {
+			return nil, fmt.Errorf("alphabet character %q is repeated", alphabet[i])
+		}
+		index[alphabet[i]] = uint64(i)
+	}
+
+	return &Base62{
+		alphabet:  alphabet,
+		index:     index,
+		minLength: minLength,
+		key:       key & obfuscatedMask,
+		inverse:   modInverse(multiplier),
+	}, nil
+}
+
+func modInverse(a uint64) uint64 {
+	inv := a
+	for i := 0; i < 6; i++ {
+		inv *= 2 - a*inv
+	}
+	return inv & obfuscatedMask
+}
+
+func (b *Base62) obfuscate(x uint64) uint64 {
+	x = (x ^ b.key) & obfuscatedMask
+	x = (x * multiplier) & obfuscatedMask
+	x ^= x >> (obfuscatedBits / 2)
+	return (x * multiplier) & obfuscatedMask
+}
+
+func (b *Base62) reveal(x uint64) uint64 {
+	x = (x * b.inverse) & obfuscatedMask
+	x ^= x >> (obfuscatedBits / 2)
+	x = (x * b.inverse) & obfuscatedMask
+	return x ^ b.key
+}
+
+func (b *Base62) Kind() string {
+	return KindBase62
+}
+
+func (b *Base62) Encode(id int) string {
+	x := uint64(id)
+	if b.key != 0 {
+		x = b.obfuscate(x)
+	}
+
+	base := uint64(len(b.alphabet))
+	code := make([]byte, 0, 8)
+	for x > 0 {
+		code = append(code, b.alphabet[x%base])
+		x /= base
+	}
+	for len(code) < b.minLength || len(code) == 0 {
+		code = append(code, b.alphabet[0])
+	}
+
+	for i, j := 0, len(code)-1; i < j; i, j = i+1, j-1 {
+		code[i], code[j] = code[j], code[i]
+	}
+	return string(code)
+}
+
+func (b *Base62) Decode(code string) (int, error) {
+	var x uint64
+
+	if code == "" {
+		return 0, ErrInvalidCode
+	}
+
+	base := uint64(len(b.alphabet))
+	for i := 0; i < len(code); i++ {
+		digit, found := b.index[code[i]]
+		if !found || x > (obfuscatedMask-digit)/base {
+			return 0, ErrInvalidCode
+		}
+		x = x*base + digit
+	}
+
+	if b.key != 0 {
+		x = b.reveal(x)
+	}
+	if x == 0 || x > obfuscatedMask {
+		return 0, ErrInvalidCode
+	}
+	return int(x), nil
+}
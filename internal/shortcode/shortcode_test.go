@@ -0,0 +1,69 @@
+package shortcode
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBase62RoundTrip(t *testing.T) {
+	plain, err := NewBase62("", 0, 0)
+	require.NoError(t, err)
+	obfuscated, err := NewBase62("", 6, 0x1234abcd)
+	require.NoError(t, err)
+
+	assert.Equal(t, "1", plain.Encode(1))
+	assert.Equal(t, "Z", plain.Encode(61))
+	assert.Equal(t, "10", plain.Encode(62))
+
+	seen := make(map[string]bool)
+	for _, g := range []Generator{Numeric{}, plain, obfuscated} {
+		for id := 1; id < 5000; id++ {
+			code := g.Encode(id)
+			decoded, err := g.Decode(code)
+			require.NoError(t, err)
+			require.Equal(t, id, decoded)
+
+			if g == obfuscated {
+				assert.GreaterOrEqual(t, len(code), 6)
+				assert.False(t, seen[code])
+				seen[code] = true
+			}
+		}
+	}
+
+	assert.NotEqual(t, "000002", obfuscated.Encode(2))
+}
+
+func TestBase62InvalidInput(t *testing.T) {
+	_, err := NewBase62("aab", 0, 0)
+	assert.Error(t, err)
+	_, err = NewBase62("ab/", 0, 0)
+	assert.Error(t, err)
+	_, err = New("uuid", "", 0, 0)
+	assert.Error(t, err)
+
+	g, err := NewBase62("", 0, 0)
+	require.NoError(t, err)
+	_, err = g.Decode("spring-sale")
+	assert.ErrorIs(t, err, ErrInvalidCode)
+	_, err = g.Decode("")
+	assert.ErrorIs(t, err, ErrInvalidCode)
+	_, err = Numeric{}.Decode("-1")
+	assert.ErrorIs(t, err, ErrInvalidCode)
+}
+
+func TestSet(t *testing.T) {
+	g, err := New(KindNumeric, "", 6, 42)
+	require.NoError(t, err)
+	set, ok := g.(*Set)
+	require.True(t, ok)
+	assert.Equal(t, KindNumeric, set.Kind())
+	assert.Equal(t, "7", set.Encode(7))
+	require.NotNil(t, set.Of(KindBase62))
+	assert.GreaterOrEqual(t, len(set.Of(KindBase62).Encode(7)), 6)
+
+	g, err = New(KindNumeric, "aab", 0, 0)
+	require.NoError(t, err, "base62 settings are not needed for numeric codes")
+	assert.Nil(t, g.(*Set).Of(KindBase62))
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+)
+
+// Checked refuses to add URLs the Checker blocks and stops resolving stored ones it blocks later
+type Checked struct {
+	Storage
+	Checker middleware.URLChecker
+}
+
+func (c *Checked) AddURL(ctx context.Context, url URL, user string) (string, error) {
+	if err := c.Checker.CheckURL(ctx, url.FullURL); err != nil {
+		return "", err
+	}
+	return c.Storage.AddURL(ctx, url, user)
+}
+
+func (c *Checked) AddURLs(ctx context.Context, urls []URL, user string, atomic bool) ([]AddResult, error) {
+	return addURLsWith(ctx, c.Storage, urls, user, atomic, func(url URL) (URL, error) {
+		return url, c.Checker.CheckURL(ctx, url.FullURL)
+	})
+}
+
+// addURLsWith passes urls through prepare before adding them to st, the ones it fails on are not added,
+// so in an atomic batch nothing is
+func addURLsWith(ctx context.Context, st Storage, urls []URL, user string, atomic bool,
+	prepare func(url URL) (URL, error)) ([]AddResult, error) {
+
+	var (
+		prepared  []URL
+		positions []int
+	)
+
+	results := make([]AddResult, len(urls))
+	for i, url := range urls {
+		url, err := prepare(url)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		prepared = append(prepared, url)
+		positions = append(positions, i)
+	}
+
+	if atomic && len(prepared) < len(urls) {
+		for _, i := range positions {
+			results[i].Err = middleware.ErrRolledBack
+		}
+		return results, nil
+	}
+
+	added, err := st.AddURLs(ctx, prepared, user, atomic)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range positions {
+		results[i] = added[j]
+	}
+	return results, nil
+}
+
+func (c *Checked) SearchURL(ctx context.Context, short string) (string, error) {
+	url, err := c.Storage.SearchURL(ctx, short)
+	if err != nil {
+		return "", err
+	}
+	if err := c.Checker.CheckURL(ctx, url); err != nil {
+		return "", err
+	}
+	return url, nil
+}
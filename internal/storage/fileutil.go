@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// appendFile writes data at the end of the file and waits until it reaches the disk,
+// a failed write is cut off so that the next append does not get glued to a partial record,
+// only a crash may leave a torn last line, it is dropped on load
+func appendFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		if truncErr := file.Truncate(info.Size()); truncErr != nil {
+			err = fmt.Errorf("%w, partial record is left in %s: %v", err, path, truncErr)
+		}
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeFileAtomic replaces the file so that readers see either the old or the new content
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
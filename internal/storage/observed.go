@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"time"
+)
+
+type Observer interface {
+	ObserveStorage(backend string, operation string, d time.Duration)
+}
+
+// Observed reports how long every operation of the wrapped storage takes
+type Observed struct {
+	Storage
+	Backend  string
+	Observer Observer
+}
+
+func (o *Observed) observe(operation string, start time.Time) {
+	o.Observer.ObserveStorage(o.Backend, operation, time.Since(start))
+}
+
+func (o *Observed) AddURL(ctx context.Context, url URL, user string) (string, error) {
+	defer o.observe("add_url", time.Now())
+	return o.Storage.AddURL(ctx, url, user)
+}
+
+func (o *Observed) AddURLs(ctx context.Context, urls []URL, user string, atomic bool) ([]AddResult, error) {
+	defer o.observe("add_urls", time.Now())
+	return o.Storage.AddURLs(ctx, urls, user, atomic)
+}
+
+func (o *Observed) SearchURL(ctx context.Context, short string) (string, error) {
+	defer o.observe("search_url", time.Now())
+	return o.Storage.SearchURL(ctx, short)
+}
+
+func (o *Observed) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
+	defer o.observe("get_user_urls", time.Now())
+	return o.Storage.GetAllURLForUser(ctx, user)
+}
+
+func (o *Observed) Ping(ctx context.Context) error {
+	defer o.observe("ping", time.Now())
+	return o.Storage.Ping(ctx)
+}
+
+func (o *Observed) DeleteURLs(ctx context.Context, user string, ids []string) error {
+	defer o.observe("delete_urls", time.Now())
+	return o.Storage.DeleteURLs(ctx, user, ids)
+}
+
+func (o *Observed) PurgeExpired(ctx context.Context) (int, error) {
+	defer o.observe("purge_expired", time.Now())
+	return o.Storage.PurgeExpired(ctx)
+}
+
+func (o *Observed) RecordClick(ctx context.Context, short string, at time.Time) error {
+	defer o.observe("record_click", time.Now())
+	return o.Storage.RecordClick(ctx, short, at)
+}
+
+func (o *Observed) GetURLStats(ctx context.Context, user string, short string) (middleware.JSONURLStats, error) {
+	defer o.observe("get_url_stats", time.Now())
+	return o.Storage.GetURLStats(ctx, user, short)
+}
+
+func (o *Observed) GetStats(ctx context.Context) (middleware.JSONInternalStats, error) {
+	defer o.observe("get_stats", time.Now())
+	return o.Storage.GetStats(ctx)
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"net/url"
+	"strings"
+)
+
+// SelfLinks keeps short URLs from pointing at other short URLs of the shortener, so no chains or loops
+// of redirects can be built: such targets are replaced with what they redirect to, following at most
+// MaxDepth short URLs, and rejected when the chain is longer, a short URL is deleted or expired or MaxDepth is 0,
+// other pages of the shortener are not short URLs and are stored as they are
+type SelfLinks struct {
+	Storage
+	MaxDepth int
+
+	prefixes []string
+}
+
+// NewSelfLinks takes the base URLs short URLs are served at, the first one is usually BaseURL
+func NewSelfLinks(st Storage, maxDepth int, baseURLs ...string) (*SelfLinks, error) {
+	sl := &SelfLinks{Storage: st, MaxDepth: maxDepth}
+	for _, baseURL := range baseURLs {
+		prefix, err := linkAddress(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("short domain %q: %w", baseURL, err)
+		}
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		sl.prefixes = append(sl.prefixes, prefix)
+	}
+	return sl, nil
+}
+
+// linkAddress is the canonical host, port and path of a URL, the scheme and its own default port are dropped
+// since the shortener is usually reachable over both http and https
+func linkAddress(rawURL string) (string, error) {
+	canonical, err := middleware.URLPolicy{}.Canonicalize(rawURL)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(canonical)
+	if err != nil {
+		return "", err
+	}
+
+	host := u.Host
+	if port := u.Port(); u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443" {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	return host + u.EscapedPath(), nil
+}
+
+// shortCode tells the short code of rawURL if it is a short URL of the shortener
+func (sl *SelfLinks) shortCode(rawURL string) (string, bool) {
+	address, err := linkAddress(rawURL)
+	if err != nil {
+		return "", false
+	}
+
+	for _, prefix := range sl.prefixes {
+		if !strings.HasPrefix(address, prefix) {
+			continue
+		}
+		if code := strings.TrimPrefix(address, prefix); code != "" && !strings.Contains(code, "/") {
+			return code, true
+		}
+	}
+	return "", false
+}
+
+func (sl *SelfLinks) resolve(ctx context.Context, url string) (string, error) {
+	for depth := 0; ; depth++ {
+		code, short := sl.shortCode(url)
+		if !short {
+			return url, nil
+		}
+
+		target, err := sl.Storage.SearchURL(ctx, code)
+		if errors.Is(err, middleware.ErrNotFound) {
+			return url, nil
+		} else if errors.Is(err, middleware.ErrGone) {
+			return "", fmt.Errorf("%w: %s does not redirect anywhere", middleware.ErrRedirectLoop, url)
+		} else if err != nil {
+			return "", err
+		} else if depth >= sl.MaxDepth {
+			return "", fmt.Errorf("%w: %s is a short URL of the shortener", middleware.ErrRedirectLoop, url)
+		}
+		url = target
+	}
+}
+
+func (sl *SelfLinks) AddURL(ctx context.Context, url URL, user string) (string, error) {
+	target, err := sl.resolve(ctx, url.FullURL)
+	if err != nil {
+		return "", err
+	}
+	url.FullURL = target
+	return sl.Storage.AddURL(ctx, url, user)
+}
+
+func (sl *SelfLinks) AddURLs(ctx context.Context, urls []URL, user string, atomic bool) ([]AddResult, error) {
+	return addURLsWith(ctx, sl.Storage, urls, user, atomic, func(url URL) (URL, error) {
+		var err error
+		url.FullURL, err = sl.resolve(ctx, url.FullURL)
+		return url, err
+	})
+}
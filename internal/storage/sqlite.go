@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/shortcode"
+	"strings"
+	"time"
+)
+
+const (
+	sqliteParams = "?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on&_txlock=immediate"
+
+	// sqliteResolveCondition is resolveCondition for SQLite, ?1 - ?4 are the same as in resolveArgs
+	sqliteResolveCondition = "(alias = ?1 or (id = ?2 and coalesce(code_kind, '') = ?4) " +
+		"or (id = ?3 and code_kind is null))"
+	sqliteResolveOrder = "order by case when alias = ?1 then 0 else 1 end limit 1"
+)
+
+type SQLite struct {
+	BaseURL string
+	Path    string
+	DB      *sql.DB
+	Codes   shortcode.Generator
+}
+
+func (sl *SQLite) GetDBConnection() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", sl.Path+sqliteParams)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite has a single writer, one connection keeps writers from failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (sl *SQLite) Ping(ctx context.Context) error {
+	return sl.DB.PingContext(ctx)
+}
+
+func (sl *SQLite) Close() error {
+	return sl.DB.Close()
+}
+
+func (sl *SQLite) shortURL(id int, alias string, kind string) string {
+	if alias != "" {
+		return sl.BaseURL + alias
+	}
+	return sl.BaseURL + codesOf(sl.Codes, kind).Encode(id)
+}
+
+func isUniqueViolation(err error, column string) bool {
+	var sqliteErr sqlite3.Error
+
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique &&
+		strings.Contains(sqliteErr.Error(), column)
+}
+
+func (sl *SQLite) AddURL(ctx context.Context, url URL, user string) (string, error) {
+	results, err := sl.AddURLs(ctx, []URL{url}, user, false)
+	if err != nil {
+		return "", err
+	}
+	return results[0].ShortURL, results[0].Err
+}
+
+func (sl *SQLite) AddURLs(ctx context.Context, urls []URL, user string, atomic bool) ([]AddResult, error) {
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]AddResult, len(urls))
+	for i, url := range urls {
+		results[i].ShortURL, results[i].Err = sl.addURL(ctx, tx, url, user)
+		if results[i].Err != nil && !itemError(results[i].Err) {
+			return nil, results[i].Err
+		}
+	}
+	if atomic && batchFailed(results) {
+		markRolledBack(results)
+		return results, tx.Rollback()
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (sl *SQLite) addURL(ctx context.Context, tx *sql.Tx, url URL, user string) (string, error) {
+	var (
+		id          int
+		alias, kind string
+		found       bool
+	)
+
+	if err := checkAlias(url.Alias); err != nil {
+		return "", err
+	}
+
+	err := tx.QueryRowContext(ctx,
+		"select id, coalesce(alias, ''), coalesce(code_kind, '') from storage where full_url = ?",
+		url.FullURL).Scan(&id, &alias, &kind)
+	if err == nil {
+		return sl.shortURL(id, alias, kind), middleware.ErrConflict
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	if url.Alias != "" {
+		err = tx.QueryRowContext(ctx,
+			"select exists(select 1 from storage where "+sqliteResolveCondition+")",
+			resolveArgs(sl.Codes, url.Alias)...).Scan(&found)
+		if err != nil {
+			return "", err
+		} else if found {
+			return "", middleware.ErrAliasConflict
+		}
+	}
+
+	if err := tx.QueryRowContext(ctx, "select coalesce(max(id), 0) from storage").Scan(&id); err != nil {
+		return "", err
+	}
+	for id++; url.Alias == "" && codeKind(sl.Codes) != ""; id++ {
+		code := codesOrDefault(sl.Codes).Encode(id)
+		if shadowsLegacy(sl.Codes, code) {
+			continue
+		}
+		err := tx.QueryRowContext(ctx, "select exists(select 1 from storage where alias = ?)", code).Scan(&found)
+		if err != nil {
+			return "", err
+		} else if !found {
+			break
+		}
+	}
+
+	var expiresAt interface{}
+	if !url.ExpiresAt.IsZero() {
+		expiresAt = url.ExpiresAt.UTC()
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"insert into storage (id, full_url, user_id, alias, code_kind, expires_at) "+
+			"values (?, ?, ?, nullif(?, ''), nullif(?, ''), ?)",
+		id, url.FullURL, user, url.Alias, codeKind(sl.Codes), expiresAt)
+	if isUniqueViolation(err, "storage.alias") {
+		return "", middleware.ErrAliasConflict
+	} else if err != nil {
+		return "", err
+	}
+	return sl.shortURL(id, url.Alias, codeKind(sl.Codes)), nil
+}
+
+func (sl *SQLite) SearchURL(ctx context.Context, short string) (string, error) {
+	var (
+		url       string
+		isDeleted bool
+	)
+
+	err := sl.DB.QueryRowContext(ctx,
+		"select full_url, is_deleted or coalesce(expires_at <= ?5, false) from storage "+
+			"where "+sqliteResolveCondition+" "+sqliteResolveOrder,
+		resolveArgs(sl.Codes, short, time.Now().UTC())...).Scan(&url, &isDeleted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", middleware.ErrNotFound
+	} else if err != nil {
+		return "", err
+	} else if isDeleted {
+		return "", middleware.ErrGone
+	}
+	return url, nil
+}
+
+func (sl *SQLite) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
+	var JSONStructList []middleware.JSONStructForAuth
+
+	row, err := sl.DB.QueryContext(ctx,
+		"select id, full_url, coalesce(alias, ''), coalesce(code_kind, '') from storage "+
+			"where user_id = ? and not is_deleted and (expires_at is null or expires_at > ?) order by id",
+		user, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var (
+			id                   int
+			fullURL, alias, kind string
+		)
+		if err := row.Scan(&id, &fullURL, &alias, &kind); err != nil {
+			return nil, err
+		}
+		JSONStructList = append(JSONStructList, middleware.JSONStructForAuth{
+			ShortURL:    sl.shortURL(id, alias, kind),
+			OriginalURL: fullURL,
+		})
+	}
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(JSONStructList) == 0 {
+		return JSONStructList, middleware.ErrNoContent
+	}
+	return JSONStructList, nil
+}
+
+func (sl *SQLite) DeleteURLs(ctx context.Context, user string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := sl.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		_, err := tx.ExecContext(ctx,
+			"update storage set is_deleted = true where user_id = ?5 and id = ("+
+				"select id from storage where "+sqliteResolveCondition+" "+sqliteResolveOrder+")",
+			resolveArgs(sl.Codes, id, user)...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (sl *SQLite) PurgeExpired(ctx context.Context) (int, error) {
+	res, err := sl.DB.ExecContext(ctx,
+		"update storage set is_deleted = true where expires_at <= ? and not is_deleted", time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := res.RowsAffected()
+	return int(count), err
+}
+
+func (sl *SQLite) GetStats(ctx context.Context) (middleware.JSONInternalStats, error) {
+	var stats middleware.JSONInternalStats
+
+	err := sl.DB.QueryRowContext(ctx,
+		"select count(*), count(distinct nullif(user_id, '')) from storage "+
+			"where not is_deleted and (expires_at is null or expires_at > ?)",
+		time.Now().UTC()).Scan(&stats.URLs, &stats.Users)
+	return stats, err
+}
+
+func (sl *SQLite) RecordClick(ctx context.Context, short string, at time.Time) error {
+	at = at.UTC()
+
+	res, err := sl.DB.ExecContext(ctx,
+		"insert into clicks (url_id, day, total, last_accessed) "+
+			"select id, ?5, 1, ?6 from storage where "+sqliteResolveCondition+" "+sqliteResolveOrder+" "+
+			"on conflict (url_id, day) do update set total = total + 1, "+
+			"last_accessed = max(last_accessed, excluded.last_accessed)",
+		resolveArgs(sl.Codes, short, at.Format(dayLayout), at)...)
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if count == 0 {
+		return middleware.ErrNotFound
+	}
+	return nil
+}
+
+func (sl *SQLite) GetURLStats(ctx context.Context, user string, short string) (middleware.JSONURLStats, error) {
+	var (
+		id                          int
+		fullURL, alias, kind, owner string
+		stats                       middleware.JSONURLStats
+	)
+
+	err := sl.DB.QueryRowContext(ctx,
+		"select id, full_url, coalesce(alias, ''), coalesce(code_kind, ''), coalesce(user_id, '') "+
+			"from storage where "+sqliteResolveCondition+" "+sqliteResolveOrder,
+		resolveArgs(sl.Codes, short)...).Scan(&id, &fullURL, &alias, &kind, &owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return stats, middleware.ErrNotFound
+	} else if err != nil {
+		return stats, err
+	} else if owner != user {
+		return stats, middleware.ErrForbidden
+	}
+
+	stats = middleware.JSONURLStats{
+		ShortURL:    sl.shortURL(id, alias, kind),
+		OriginalURL: fullURL,
+		Daily:       []middleware.JSONDailyClicks{},
+	}
+
+	row, err := sl.DB.QueryContext(ctx,
+		"select day, total, last_accessed from clicks where url_id = ? order by day", id)
+	if err != nil {
+		return stats, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var (
+			day          string
+			total        int64
+			lastAccessed time.Time
+		)
+		if err := row.Scan(&day, &total, &lastAccessed); err != nil {
+			return stats, err
+		}
+
+		stats.Clicks += total
+		if stats.LastAccessed == nil || lastAccessed.After(*stats.LastAccessed) {
+			stats.LastAccessed = &lastAccessed
+		}
+		stats.Daily = append(stats.Daily, middleware.JSONDailyClicks{Date: day, Clicks: total})
+	}
+
+	return stats, row.Err()
+}
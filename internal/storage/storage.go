@@ -1,65 +1,377 @@
 package storage
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	middleware "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/shortcode"
 	"log"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 )
 
+type AddResult struct {
+	ShortURL string
+	Err      error
+}
+
+type URL struct {
+	FullURL   string
+	Alias     string
+	ExpiresAt time.Time
+}
+
 type Storage interface {
-	AddURL(ctx context.Context, url string, user string) (string, error)
-	SearchURL(ctx context.Context, id int) (string, error)
+	AddURL(ctx context.Context, url URL, user string) (string, error)
+	AddURLs(ctx context.Context, urls []URL, user string, atomic bool) ([]AddResult, error)
+	SearchURL(ctx context.Context, short string) (string, error)
 	GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error)
 	Ping(ctx context.Context) error
+	DeleteURLs(ctx context.Context, user string, ids []string) error
+	PurgeExpired(ctx context.Context) (int, error)
+	RecordClick(ctx context.Context, short string, at time.Time) error
+	GetURLStats(ctx context.Context, user string, short string) (middleware.JSONURLStats, error)
+	GetStats(ctx context.Context) (middleware.JSONInternalStats, error)
+	Close() error
+}
+
+const dayLayout = "2006-01-02"
+
+type ClickStats struct {
+	Total        int64
+	LastAccessed time.Time
+	Daily        map[string]int64
+}
+
+func (cs *ClickStats) add(at time.Time, clicks int64) *ClickStats {
+	if cs == nil {
+		cs = &ClickStats{Daily: make(map[string]int64)}
+	}
+
+	cs.Total += clicks
+	if at.After(cs.LastAccessed) {
+		cs.LastAccessed = at
+	}
+	cs.Daily[at.UTC().Format(dayLayout)] += clicks
+	return cs
+}
+
+// records tells the clicks of url id one record per day, the record of the last day keeps the last access
+func (cs *ClickStats) records(id int) []middleware.JSONClick {
+	var records []middleware.JSONClick
+
+	lastDay := cs.LastAccessed.UTC().Format(dayLayout)
+	for day, clicks := range cs.Daily {
+		at, err := time.Parse(dayLayout, day)
+		if err != nil {
+			continue
+		} else if day == lastDay {
+			at = cs.LastAccessed
+		}
+		records = append(records, middleware.JSONClick{ShortenURL: id, At: at, Clicks: clicks})
+	}
+	return records
+}
+
+func (cs *ClickStats) toJSON(shortURL string, originalURL string) middleware.JSONURLStats {
+	stats := middleware.JSONURLStats{
+		ShortURL:    shortURL,
+		OriginalURL: originalURL,
+		Daily:       []middleware.JSONDailyClicks{},
+	}
+	if cs == nil {
+		return stats
+	}
+
+	lastAccessed := cs.LastAccessed
+	stats.Clicks = cs.Total
+	stats.LastAccessed = &lastAccessed
+	for day, clicks := range cs.Daily {
+		stats.Daily = append(stats.Daily, middleware.JSONDailyClicks{Date: day, Clicks: clicks})
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool {
+		return stats.Daily[i].Date < stats.Daily[j].Date
+	})
+	return stats
+}
+
+var (
+	aliasPattern    = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	reservedAliases = map[string]bool{"api": true, "ping": true}
+)
+
+func checkAlias(alias string) error {
+	if alias == "" {
+		return nil
+	}
+	if _, err := strconv.Atoi(alias); err == nil || !aliasPattern.MatchString(alias) || reservedAliases[alias] {
+		return middleware.ErrInvalidAlias
+	}
+	return nil
+}
+
+// itemError tells errors of a single URL in a batch from failures of the whole storage
+func itemError(err error) bool {
+	return errors.Is(err, middleware.ErrConflict) || errors.Is(err, middleware.ErrAliasConflict) ||
+		errors.Is(err, middleware.ErrInvalidAlias)
+}
+
+func batchFailed(results []AddResult) bool {
+	for _, result := range results {
+		if result.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func markRolledBack(results []AddResult) {
+	for i := range results {
+		if results[i].Err == nil {
+			results[i] = AddResult{Err: middleware.ErrRolledBack}
+		}
+	}
+}
+
+func codesOrDefault(codes shortcode.Generator) shortcode.Generator {
+	if codes == nil {
+		return shortcode.Numeric{}
+	}
+	return codes
+}
+
+func codeKind(codes shortcode.Generator) string {
+	if kind := codesOrDefault(codes).Kind(); kind != shortcode.KindNumeric {
+		return kind
+	}
+	return ""
+}
+
+// codesOf is the generator records stored with kind were encoded with, numeric codes are stored without a kind
+func codesOf(codes shortcode.Generator, kind string) shortcode.Generator {
+	if kind == "" {
+		return shortcode.Numeric{}
+	}
+	if set, ok := codes.(*shortcode.Set); ok {
+		if of := set.Of(kind); of != nil {
+			return of
+		}
+	}
+	return codesOrDefault(codes)
+}
+
+// storedCodes is the generator short codes are looked up with besides the numeric ids,
+// after switching back to numeric codes it is the one the records with a kind were made with
+func storedCodes(codes shortcode.Generator) shortcode.Generator {
+	if codeKind(codes) != "" {
+		return codesOrDefault(codes)
+	}
+	return codesOf(codes, shortcode.KindBase62)
+}
+
+func shadowsLegacy(codes shortcode.Generator, code string) bool {
+	_, err := strconv.Atoi(code)
+	return err == nil && codeKind(codes) != ""
+}
+
+func nextFreeID(id int, codes shortcode.Generator, aliases map[string]int) int {
+	for {
+		id = id + 1
+		code := codes.Encode(id)
+		if _, taken := aliases[code]; !taken && !shadowsLegacy(codes, code) {
+			return id
+		}
+	}
+}
+
+func expired(expiresAt map[int]time.Time, id int, now time.Time) bool {
+	at, found := expiresAt[id]
+	return found && !at.After(now)
+}
+
+// countLive counts URLs that are neither deleted nor expired and the users owning at least one of them
+func countLive(idURL map[int]string, userURLs map[string][]int, deleted map[int]bool,
+	expiresAt map[int]time.Time, now time.Time) middleware.JSONInternalStats {
+
+	var stats middleware.JSONInternalStats
+	live := func(id int) bool {
+		return idURL[id] != "" && !deleted[id] && !expired(expiresAt, id, now)
+	}
+
+	for id := range idURL {
+		if live(id) {
+			stats.URLs++
+		}
+	}
+	for user, ids := range userURLs {
+		if user == "" {
+			continue
+		}
+		for _, id := range ids {
+			if live(id) {
+				stats.Users++
+				break
+			}
+		}
+	}
+	return stats
+}
+
+func owns(owned []int, id int) bool {
+	for _, ownedID := range owned {
+		if ownedID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func ownedIDs(owned []int, shorts []string, resolve func(short string) (int, bool)) []int {
+	var result []int
+
+	isOwned := make(map[int]bool, len(owned))
+	for _, id := range owned {
+		isOwned[id] = true
+	}
+
+	for _, short := range shorts {
+		if id, found := resolve(short); found && isOwned[id] {
+			result = append(result, id)
+		}
+	}
+	return result
 }
 
 //MEMORY PART//
 
 type Memory struct {
-	BaseURL  string
-	mu       sync.Mutex
-	ID       int
-	URLID    map[string]int
-	IDURL    map[int]string
-	UserURLs map[string][]int
+	BaseURL   string
+	mu        sync.Mutex
+	ID        int
+	URLID     map[string]int
+	IDURL     map[int]string
+	UserURLs  map[string][]int
+	Deleted   map[int]bool
+	Aliases   map[string]int
+	IDAlias   map[int]string
+	ExpiresAt map[int]time.Time
+	Clicks    map[int]*ClickStats
+	Codes     shortcode.Generator
 }
 
-func (m *Memory) AddURL(_ context.Context, url string, user string) (string, error) {
+func (m *Memory) shortURL(id int) string {
+	if alias := m.IDAlias[id]; alias != "" {
+		return m.BaseURL + alias
+	}
+	return m.BaseURL + codesOrDefault(m.Codes).Encode(id)
+}
+
+func (m *Memory) resolve(short string) (int, bool) {
+	if id, found := m.Aliases[short]; found {
+		return id, true
+	}
+	if id, err := codesOrDefault(m.Codes).Decode(short); err == nil && m.IDURL[id] != "" {
+		return id, true
+	}
+	return 0, false
+}
+
+func (m *Memory) AddURL(ctx context.Context, url URL, user string) (string, error) {
+	results, err := m.AddURLs(ctx, []URL{url}, user, false)
+	if err != nil {
+		return "", err
+	}
+	return results[0].ShortURL, results[0].Err
+}
+
+func (m *Memory) AddURLs(_ context.Context, urls []URL, user string, atomic bool) ([]AddResult, error) {
+	var added []int
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, found := m.URLID[url]; !found {
-		m.ID = m.ID + 1
-		m.URLID[url] = m.ID
-		m.IDURL[m.ID] = url
-		m.UserURLs[user] = append(m.UserURLs[user], m.ID)
+	lastID := m.ID
+
+	results := make([]AddResult, len(urls))
+	for i, url := range urls {
+		results[i].ShortURL, results[i].Err = m.addURL(url, user)
+		if results[i].Err == nil {
+			added = append(added, m.ID)
+		}
+	}
+
+	if atomic && batchFailed(results) {
+		m.forget(added, user)
+		m.ID = lastID
+		markRolledBack(results)
+		return results, nil
 	}
-	_, found := m.URLID[url]
-	if m.URLID[url] != m.ID || m.IDURL[m.ID] != url || !found {
-		return "", errors.New("error while adding new URL")
-	} else {
-		log.Println("url", url, "added to storage, you can get access by shorten:",
-			m.BaseURL+strconv.Itoa(m.URLID[url]))
-		return m.BaseURL + strconv.Itoa(m.URLID[url]), nil
+
+	for _, id := range added {
+		log.Println("url", m.IDURL[id], "added to storage, you can get access by shorten:", m.shortURL(id))
+	}
+	return results, nil
+}
+
+func (m *Memory) forget(ids []int, user string) {
+	for _, id := range ids {
+		delete(m.URLID, m.IDURL[id])
+		delete(m.IDURL, id)
+		delete(m.Aliases, m.IDAlias[id])
+		delete(m.IDAlias, id)
+		delete(m.ExpiresAt, id)
+	}
+
+	owned := m.UserURLs[user]
+	m.UserURLs[user] = owned[:len(owned)-len(ids)]
+}
+
+func (m *Memory) addURL(url URL, user string) (string, error) {
+	if err := checkAlias(url.Alias); err != nil {
+		return "", err
+	}
+
+	if id, found := m.URLID[url.FullURL]; found {
+		return m.shortURL(id), middleware.ErrConflict
+	}
+	if _, found := m.resolve(url.Alias); found && url.Alias != "" {
+		return "", middleware.ErrAliasConflict
+	}
+
+	m.ID = nextFreeID(m.ID, codesOrDefault(m.Codes), m.Aliases)
+	m.URLID[url.FullURL] = m.ID
+	m.IDURL[m.ID] = url.FullURL
+	m.UserURLs[user] = append(m.UserURLs[user], m.ID)
+	if url.Alias != "" {
+		m.Aliases[url.Alias] = m.ID
+		m.IDAlias[m.ID] = url.Alias
 	}
+	if !url.ExpiresAt.IsZero() {
+		m.ExpiresAt[m.ID] = url.ExpiresAt
+	}
+	return m.shortURL(m.ID), nil
 }
 
-func (m *Memory) SearchURL(_ context.Context, id int) (string, error) {
+func (m *Memory) SearchURL(_ context.Context, short string) (string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if m.IDURL[id] != "" {
+	id, _ := m.resolve(short)
+	if m.Deleted[id] || expired(m.ExpiresAt, id, time.Now()) {
+		return "", middleware.ErrGone
+	} else if m.IDURL[id] != "" {
 		return m.IDURL[id], nil
 	} else {
-		return "", errors.New("no URL with this ID")
+		return "", middleware.ErrNotFound
 	}
 
 }
@@ -76,12 +388,16 @@ func (m *Memory) GetAllURLForUser(ctx context.Context, user string) ([]middlewar
 
 	URLs := make([]int, len(m.UserURLs[user]))
 	copy(URLs, m.UserURLs[user])
+	now := time.Now()
 
 	if len(m.UserURLs[user]) == 0 {
 		return JSONStructList, middleware.ErrNoContent
 	} else {
 		for i := range URLs {
-			JSONStruct.ShortURL = m.BaseURL + strconv.Itoa(m.UserURLs[user][i])
+			if m.Deleted[URLs[i]] || expired(m.ExpiresAt, URLs[i], now) {
+				continue
+			}
+			JSONStruct.ShortURL = m.shortURL(m.UserURLs[user][i])
 
 			if m.IDURL[m.UserURLs[user][i]] != "" {
 				JSONStruct.OriginalURL = m.IDURL[m.UserURLs[user][i]]
@@ -91,119 +407,631 @@ func (m *Memory) GetAllURLForUser(ctx context.Context, user string) ([]middlewar
 
 			JSONStructList = append(JSONStructList, JSONStruct)
 		}
+		if len(JSONStructList) == 0 {
+			return JSONStructList, middleware.ErrNoContent
+		}
 		return JSONStructList, nil
 	}
 
 }
 
-func (m *Memory) Ping(_ context.Context) error {
-	return errors.New("there is no connection to DB")
+func (m *Memory) Ping(_ context.Context) error {
+	return errors.New("there is no connection to DB")
+}
+
+func (m *Memory) DeleteURLs(_ context.Context, user string, ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range ownedIDs(m.UserURLs[user], ids, m.resolve) {
+		m.Deleted[id] = true
+	}
+	return nil
+}
+
+func (m *Memory) RecordClick(_ context.Context, short string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, found := m.resolve(short)
+	if !found || m.IDURL[id] == "" {
+		return middleware.ErrNotFound
+	}
+	m.Clicks[id] = m.Clicks[id].add(at, 1)
+	return nil
+}
+
+func (m *Memory) GetURLStats(_ context.Context, user string, short string) (middleware.JSONURLStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, found := m.resolve(short)
+	if !found || m.IDURL[id] == "" {
+		return middleware.JSONURLStats{}, middleware.ErrNotFound
+	} else if !owns(m.UserURLs[user], id) {
+		return middleware.JSONURLStats{}, middleware.ErrForbidden
+	}
+	return m.Clicks[id].toJSON(m.shortURL(id), m.IDURL[id]), nil
+}
+
+func (m *Memory) GetStats(_ context.Context) (middleware.JSONInternalStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return countLive(m.IDURL, m.UserURLs, m.Deleted, m.ExpiresAt, time.Now()), nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) PurgeExpired(_ context.Context) (int, error) {
+	var count int
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id := range m.ExpiresAt {
+		if expired(m.ExpiresAt, id, now) && !m.Deleted[id] {
+			m.Deleted[id] = true
+			count++
+		}
+	}
+	return count, nil
+}
+
+//FILE PART//
+
+type File struct {
+	BaseURL        string
+	Filepath       string
+	mu             sync.Mutex
+	ID             int
+	URLID          map[string]int
+	IDURL          map[int]string
+	UserURLs       map[string][]int
+	Deleted        map[int]bool
+	Aliases        map[string]int
+	IDAlias        map[int]string
+	CodeKinds      map[int]string
+	ExpiresAt      map[int]time.Time
+	Clicks         map[int]*ClickStats
+	Codes          shortcode.Generator
+	URLSToWrite    middleware.JSONStruct
+	JSONStructList []middleware.JSONStruct
+	stale          int
+
+	// clicks are kept in memory and written to the clicks file by FlushClicks aggregated by url and day,
+	// clicksMu is taken before mu and keeps flushes and compactions of the clicks file apart
+	clicksMu      sync.Mutex
+	pendingClicks map[clickKey]middleware.JSONClick
+	staleClicks   int
+}
+
+type clickKey struct {
+	id  int
+	day string
+}
+
+func (f *File) NewFromFile(baseURL string, targets []middleware.JSONStruct) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.JSONStructList = targets
+
+	for _, t := range targets {
+		f.URLID[t.FullURL] = t.ShortenURL
+		f.IDURL[t.ShortenURL] = t.FullURL
+		f.UserURLs[t.User] = append(f.UserURLs[t.User], t.ShortenURL)
+		f.Deleted[t.ShortenURL] = t.Deleted
+		if t.Alias != "" {
+			f.Aliases[t.Alias] = t.ShortenURL
+			f.IDAlias[t.ShortenURL] = t.Alias
+		}
+		if t.CodeKind != "" {
+			f.CodeKinds[t.ShortenURL] = t.CodeKind
+		}
+		if t.ExpiresAt != nil {
+			f.ExpiresAt[t.ShortenURL] = *t.ExpiresAt
+		}
+		f.ID = t.ShortenURL
+	}
+	log.Println(len(targets), "urls were loaded from", f.Filepath)
+}
+
+func (f *File) shortURL(id int) string {
+	if alias := f.IDAlias[id]; alias != "" {
+		return f.BaseURL + alias
+	}
+	return f.BaseURL + codesOf(f.Codes, f.CodeKinds[id]).Encode(id)
+}
+
+func (f *File) resolve(short string) (int, bool) {
+	if id, found := f.Aliases[short]; found {
+		return id, true
+	}
+	codes := storedCodes(f.Codes)
+	if id, err := codes.Decode(short); err == nil && f.IDURL[id] != "" && f.CodeKinds[id] == codeKind(codes) {
+		return id, true
+	}
+	if id, err := strconv.Atoi(short); err == nil && f.IDURL[id] != "" && f.CodeKinds[id] == "" {
+		return id, true
+	}
+	return 0, false
+}
+
+func (f *File) AddURL(ctx context.Context, url URL, user string) (string, error) {
+	results, err := f.AddURLs(ctx, []URL{url}, user, false)
+	if err != nil {
+		return "", err
+	}
+	return results[0].ShortURL, results[0].Err
+}
+
+func (f *File) AddURLs(_ context.Context, urls []URL, user string, atomic bool) ([]AddResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lastID, written := f.ID, len(f.JSONStructList)
+
+	results := make([]AddResult, len(urls))
+	for i, url := range urls {
+		results[i].ShortURL, results[i].Err = f.addURL(url, user)
+	}
+
+	records := f.JSONStructList[written:]
+	if atomic && batchFailed(results) {
+		f.forget(records)
+		f.ID = lastID
+		f.JSONStructList = f.JSONStructList[:written]
+		markRolledBack(results)
+		return results, nil
+	}
+	if err := f.appendRecords(records); err != nil {
+		f.forget(records)
+		f.ID = lastID
+		f.JSONStructList = f.JSONStructList[:written]
+		return nil, err
+	}
+
+	for _, record := range records {
+		log.Println("url", record.FullURL, "added to storage, you can get access by shorten:", f.shortURL(record.ShortenURL))
+	}
+	return results, nil
+}
+
+// addURL changes only the memory, records it leaves at the end of JSONStructList are written by AddURLs
+func (f *File) addURL(url URL, user string) (string, error) {
+	if err := checkAlias(url.Alias); err != nil {
+		return "", err
+	}
+
+	if id, found := f.URLID[url.FullURL]; found {
+		return f.shortURL(id), middleware.ErrConflict
+	}
+	if _, found := f.resolve(url.Alias); found && url.Alias != "" {
+		return "", middleware.ErrAliasConflict
+	}
+
+	record := middleware.JSONStruct{
+		FullURL:    url.FullURL,
+		ShortenURL: nextFreeID(f.ID, codesOrDefault(f.Codes), f.Aliases),
+		User:       user,
+		Alias:      url.Alias,
+		CodeKind:   codeKind(f.Codes),
+	}
+	if !url.ExpiresAt.IsZero() {
+		record.ExpiresAt = &url.ExpiresAt
+	}
+
+	f.ID = record.ShortenURL
+	f.URLID[url.FullURL] = f.ID
+	f.IDURL[f.ID] = url.FullURL
+	f.UserURLs[user] = append(f.UserURLs[user], f.ID)
+	if url.Alias != "" {
+		f.Aliases[url.Alias] = f.ID
+		f.IDAlias[f.ID] = url.Alias
+	}
+	if kind := codeKind(f.Codes); kind != "" {
+		f.CodeKinds[f.ID] = kind
+	}
+	if !url.ExpiresAt.IsZero() {
+		f.ExpiresAt[f.ID] = url.ExpiresAt
+	}
+
+	f.URLSToWrite = record
+	f.JSONStructList = append(f.JSONStructList, record)
+	return f.shortURL(f.ID), nil
+}
+
+func (f *File) forget(records []middleware.JSONStruct) {
+	for i := len(records) - 1; i >= 0; i-- {
+		record := records[i]
+		delete(f.URLID, record.FullURL)
+		delete(f.IDURL, record.ShortenURL)
+		delete(f.Aliases, record.Alias)
+		delete(f.IDAlias, record.ShortenURL)
+		delete(f.CodeKinds, record.ShortenURL)
+		delete(f.ExpiresAt, record.ShortenURL)
+
+		owned := f.UserURLs[record.User]
+		f.UserURLs[record.User] = owned[:len(owned)-1]
+	}
+}
+
+func (f *File) SearchURL(_ context.Context, short string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, _ := f.resolve(short)
+	if f.Deleted[id] || expired(f.ExpiresAt, id, time.Now()) {
+		return "", middleware.ErrGone
+	} else if f.IDURL[id] != "" {
+		return f.IDURL[id], nil
+	} else {
+		return "", middleware.ErrNotFound
+	}
+}
+
+func (f *File) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
+	var (
+		JSONStructList []middleware.JSONStructForAuth
+		JSONStruct     middleware.JSONStructForAuth
+	)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if len(f.UserURLs[user]) == 0 {
+		return JSONStructList, middleware.ErrNoContent
+	} else {
+		for i := range f.UserURLs[user] {
+			if f.Deleted[f.UserURLs[user][i]] || expired(f.ExpiresAt, f.UserURLs[user][i], now) {
+				continue
+			}
+			JSONStruct.ShortURL = f.shortURL(f.UserURLs[user][i])
+			JSONStruct.OriginalURL = f.IDURL[f.UserURLs[user][i]]
+			JSONStructList = append(JSONStructList, JSONStruct)
+
+		}
+		if len(JSONStructList) == 0 {
+			return JSONStructList, middleware.ErrNoContent
+		}
+		return JSONStructList, nil
+	}
+}
+
+func (f *File) Ping(_ context.Context) error {
+	return errors.New("there is no connection to DB")
+}
+
+func (f *File) DeleteURLs(_ context.Context, user string, ids []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.markDeleted(ownedIDs(f.UserURLs[user], ids, f.resolve))
+}
+
+func (f *File) clicksPath() string {
+	return f.Filepath + ".clicks"
+}
+
+func (f *File) LoadClicks() error {
+	var click middleware.JSONClick
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.Open(f.clicksPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		click = middleware.JSONClick{}
+		if err := json.Unmarshal(scanner.Bytes(), &click); err != nil {
+			log.Printf("skip invalid click record at line %d of %s: %v", line, f.clicksPath(), err)
+			continue
+		}
+		if click.Clicks == 0 {
+			click.Clicks = 1
+		}
+		f.Clicks[click.ShortenURL] = f.Clicks[click.ShortenURL].add(click.At, click.Clicks)
+		f.staleClicks++
+	}
+	return scanner.Err()
+}
+
+// RecordClick counts the click in memory only, redirects do not wait for the disk, see FlushClicks
+func (f *File) RecordClick(_ context.Context, short string, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, found := f.resolve(short)
+	if !found || f.IDURL[id] == "" {
+		return middleware.ErrNotFound
+	}
+
+	f.Clicks[id] = f.Clicks[id].add(at, 1)
+	f.pendClick(middleware.JSONClick{ShortenURL: id, At: at, Clicks: 1})
+	return nil
+}
+
+// pendClick adds click to the ones waiting for FlushClicks, f.mu must be held
+func (f *File) pendClick(click middleware.JSONClick) {
+	if f.pendingClicks == nil {
+		f.pendingClicks = make(map[clickKey]middleware.JSONClick)
+	}
+
+	key := clickKey{id: click.ShortenURL, day: click.At.UTC().Format(dayLayout)}
+	pending, found := f.pendingClicks[key]
+	if found {
+		pending.Clicks += click.Clicks
+		if click.At.After(pending.At) {
+			pending.At = click.At
+		}
+		click = pending
+	}
+	f.pendingClicks[key] = click
+}
+
+// restoreClicks gives back the pending clicks that failed to be written, so the next flush retries them
+func (f *File) restoreClicks(pending map[clickKey]middleware.JSONClick) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, click := range pending {
+		f.pendClick(click)
+	}
+}
+
+// FlushClicks appends the clicks recorded since the last flush to the clicks file,
+// the file is written without f.mu held, so lookups and redirects go on meanwhile
+func (f *File) FlushClicks() error {
+	f.clicksMu.Lock()
+	defer f.clicksMu.Unlock()
+
+	f.mu.Lock()
+	pending := f.pendingClicks
+	f.pendingClicks = nil
+	f.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	records := make([]middleware.JSONClick, 0, len(pending))
+	for _, click := range pending {
+		records = append(records, click)
+	}
+	journal, err := clicksJournal(records)
+	if err == nil {
+		err = appendFile(f.clicksPath(), journal)
+	}
+	if err != nil {
+		f.restoreClicks(pending)
+		return err
+	}
+
+	f.mu.Lock()
+	f.staleClicks += len(records)
+	f.mu.Unlock()
+	return nil
+}
+
+// compactClicks rewrites the clicks file with one record per url and day, pending clicks included
+func (f *File) compactClicks() error {
+	var records []middleware.JSONClick
+
+	f.clicksMu.Lock()
+	defer f.clicksMu.Unlock()
+
+	// pending clicks are counted in f.Clicks already, they are dropped along with the snapshot taken
+	f.mu.Lock()
+	pending := f.pendingClicks
+	f.pendingClicks = nil
+	for id, stats := range f.Clicks {
+		records = append(records, stats.records(id)...)
+	}
+	f.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].ShortenURL != records[j].ShortenURL {
+			return records[i].ShortenURL < records[j].ShortenURL
+		}
+		return records[i].At.Before(records[j].At)
+	})
+	journal, err := clicksJournal(records)
+	if err == nil {
+		err = writeFileAtomic(f.clicksPath(), journal)
+	}
+	if err != nil {
+		f.restoreClicks(pending)
+		return err
+	}
+
+	f.mu.Lock()
+	f.staleClicks = 0
+	f.mu.Unlock()
+	return nil
+}
+
+func clicksJournal(records []middleware.JSONClick) ([]byte, error) {
+	var journal []byte
+
+	for _, record := range records {
+		jsonString, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		journal = append(append(journal, jsonString...), '\n')
+	}
+	return journal, nil
+}
+
+func (f *File) GetURLStats(_ context.Context, user string, short string) (middleware.JSONURLStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id, found := f.resolve(short)
+	if !found || f.IDURL[id] == "" {
+		return middleware.JSONURLStats{}, middleware.ErrNotFound
+	} else if !owns(f.UserURLs[user], id) {
+		return middleware.JSONURLStats{}, middleware.ErrForbidden
+	}
+	return f.Clicks[id].toJSON(f.shortURL(id), f.IDURL[id]), nil
+}
+
+func (f *File) GetStats(_ context.Context) (middleware.JSONInternalStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return countLive(f.IDURL, f.UserURLs, f.Deleted, f.ExpiresAt, time.Now()), nil
+}
+
+// Close writes the pending clicks and leaves a compacted journal behind
+func (f *File) Close() error {
+	if err := f.FlushClicks(); err != nil {
+		return err
+	}
+	if f.Stale() == 0 {
+		return nil
+	}
+	return f.Compact()
 }
 
-//FILE PART//
-
-type File struct {
-	BaseURL        string
-	Filepath       string
-	mu             sync.Mutex
-	ID             int
-	URLID          map[string]int
-	IDURL          map[int]string
-	UserURLs       map[string][]int
-	URLSToWrite    middleware.JSONStruct
-	JSONStructList []middleware.JSONStruct
-}
+func (f *File) PurgeExpired(_ context.Context) (int, error) {
+	var toDelete []int
 
-func (f *File) NewFromFile(baseURL string, targets []middleware.JSONStruct) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.JSONStructList = targets
 
-	for _, t := range targets {
-		f.URLID[t.FullURL] = t.ShortenURL
-		f.IDURL[t.ShortenURL] = t.FullURL
-		f.UserURLs[t.User] = append(f.UserURLs[t.User], t.ShortenURL)
-		f.ID = t.ShortenURL
-		log.Println("url", t.FullURL, "added to storage, you can get access by shorten:", baseURL+strconv.Itoa(t.ShortenURL))
+	now := time.Now()
+	for id := range f.ExpiresAt {
+		if expired(f.ExpiresAt, id, now) && !f.Deleted[id] {
+			toDelete = append(toDelete, id)
+		}
 	}
+	return len(toDelete), f.markDeleted(toDelete)
 }
 
-func (f *File) AddURL(_ context.Context, url string, user string) (string, error) {
+func (f *File) markDeleted(toDelete []int) error {
+	if len(toDelete) == 0 {
+		return nil
+	}
 
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	var (
+		records []middleware.JSONStruct
+		indexes []int
+	)
 
-	if _, found := f.URLID[url]; !found {
+	marked := make(map[int]bool, len(toDelete))
+	for _, id := range toDelete {
+		marked[id] = true
+	}
+	for i := range f.JSONStructList {
+		if marked[f.JSONStructList[i].ShortenURL] && !f.JSONStructList[i].Deleted {
+			record := f.JSONStructList[i]
+			record.Deleted = true
+			records = append(records, record)
+			indexes = append(indexes, i)
+		}
+	}
+	if err := f.appendRecords(records); err != nil {
+		return err
+	}
 
-		f.ID = f.ID + 1
-		f.URLID[url] = f.ID
-		f.IDURL[f.ID] = url
-		f.UserURLs[user] = append(f.UserURLs[user], f.ID)
+	for _, id := range toDelete {
+		f.Deleted[id] = true
+	}
+	for _, i := range indexes {
+		f.JSONStructList[i].Deleted = true
+	}
+	f.stale += len(records)
+	return nil
+}
 
-		f.URLSToWrite.FullURL = url
-		f.URLSToWrite.ShortenURL = f.URLID[url]
-		f.URLSToWrite.User = user
+func (f *File) appendRecords(records []middleware.JSONStruct) error {
+	var journal []byte
 
-		f.JSONStructList = append(f.JSONStructList, f.URLSToWrite)
-		jsonString, err := json.Marshal(f.JSONStructList)
+	for _, record := range records {
+		jsonString, err := json.Marshal(record)
 		if err != nil {
-			return "", err
+			return err
 		}
-		os.WriteFile(f.Filepath, jsonString, 0644)
+		journal = append(append(journal, jsonString...), '\n')
 	}
-
-	_, found := f.URLID[url]
-	if f.URLID[url] != f.ID || f.IDURL[f.ID] != url || !found {
-		return "", errors.New("error while adding new URL")
-	} else {
-		log.Println("url", url, "added to storage, you can get access by shorten:",
-			f.BaseURL+strconv.Itoa(f.URLID[url]))
-		return f.BaseURL + strconv.Itoa(f.URLID[url]), nil
+	if len(journal) == 0 {
+		return nil
 	}
+
+	return appendFile(f.Filepath, journal)
 }
 
-func (f *File) SearchURL(_ context.Context, id int) (string, error) {
+// Stale tells how many records of the journal and the clicks file a compaction would drop or merge
+func (f *File) Stale() int {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	return f.IDURL[id], nil
+
+	return f.stale + f.staleClicks
 }
 
-func (f *File) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
-	var (
-		JSONStructList []middleware.JSONStructForAuth
-		JSONStruct     middleware.JSONStructForAuth
-	)
+func (f *File) Compact() error {
+	if err := f.compactJournal(); err != nil {
+		return err
+	}
+	return f.compactClicks()
+}
+
+func (f *File) compactJournal() error {
+	var journal []byte
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	if len(f.UserURLs[user]) == 0 {
-		return JSONStructList, middleware.ErrNoContent
-	} else {
-		for i := range f.UserURLs[user] {
-			JSONStruct.ShortURL = f.BaseURL + strconv.Itoa(f.UserURLs[user][i])
-			JSONStruct.OriginalURL = f.IDURL[f.UserURLs[user][i]]
-			JSONStructList = append(JSONStructList, JSONStruct)
-
+	for _, record := range f.JSONStructList {
+		jsonString, err := json.Marshal(record)
+		if err != nil {
+			return err
 		}
-		return JSONStructList, nil
+		journal = append(append(journal, jsonString...), '\n')
 	}
-}
 
-func (f *File) Ping(_ context.Context) error {
-	return errors.New("there is no connection to DB")
+	if err := writeFileAtomic(f.Filepath, journal); err != nil {
+		return err
+	}
+	f.stale = 0
+	return nil
 }
 
 //DATABASE PART//
 
+const (
+	// resolveCondition expects $1 to be the short id, $2 and $3 its decoded and legacy numeric ids
+	// and $4 the kind it was decoded with, see resolveArgs
+	resolveCondition = "(alias = $1 or (id = $2::bigint and coalesce(code_kind, '') = $4) " +
+		"or (id = $3::bigint and code_kind is null))"
+	resolveOrder = "order by case when alias = $1 then 0 else 1 end limit 1"
+)
+
 type Database struct {
 	BaseURL        string
 	DBConnURL      string
 	ConnPool       *pgxpool.Pool
 	DBErrorConnect error
+	Codes          shortcode.Generator
 }
 
 func (db *Database) Exec(ctx context.Context, query string) (pgconn.CommandTag, error) {
+	if err := db.connected(); err != nil {
+		return nil, err
+	}
+
 	res, err := db.ConnPool.Exec(ctx, query)
 	if err != nil {
 		return nil, err
@@ -220,36 +1048,306 @@ func (db *Database) GetDBConnection(ctx context.Context) (*pgxpool.Pool, error)
 	}
 }
 
-func (db *Database) Ping(ctx context.Context) error {
-	if db.DBErrorConnect != nil {
+// connected tells why there is no pool to query, the server keeps running when DB is unreachable at startup
+func (db *Database) connected() error {
+	if db.ConnPool != nil {
+		return nil
+	} else if db.DBErrorConnect != nil {
 		return db.DBErrorConnect
-	} else {
-		err := db.ConnPool.Ping(ctx)
+	}
+	return errors.New("there is no connection to DB")
+}
+
+func (db *Database) Ping(ctx context.Context) error {
+	if err := db.connected(); err != nil {
 		return err
 	}
+	return db.ConnPool.Ping(ctx)
+}
+
+func (db *Database) Close() error {
+	if db.ConnPool != nil {
+		db.ConnPool.Close()
+	}
+	return nil
+}
+
+func (db *Database) shortURL(id int, alias string, kind string) string {
+	if alias != "" {
+		return db.BaseURL + alias
+	}
+	return db.BaseURL + codesOf(db.Codes, kind).Encode(id)
+}
+
+func resolveParams(codes shortcode.Generator, short string) (int64, int64) {
+	decoded, legacy := int64(-1), int64(-1)
+
+	if id, err := storedCodes(codes).Decode(short); err == nil {
+		decoded = int64(id)
+	}
+	if id, err := strconv.ParseInt(short, 10, 64); err == nil {
+		legacy = id
+	}
+	return decoded, legacy
+}
+
+func resolveArgs(codes shortcode.Generator, short string, args ...interface{}) []interface{} {
+	decoded, legacy := resolveParams(codes, short)
+	return append([]interface{}{short, decoded, legacy, codeKind(storedCodes(codes))}, args...)
+}
+
+func (db *Database) resolveArgs(short string, args ...interface{}) []interface{} {
+	return resolveArgs(db.Codes, short, args...)
+}
+
+// shadowingAliases finds the aliases of urls that are short codes of stored records
+func (db *Database) shadowingAliases(ctx context.Context, tx pgx.Tx, urls []URL) (map[string]bool, error) {
+	var (
+		aliases []string
+		ids     []int64
+	)
+
+	codes := storedCodes(db.Codes)
+	for _, url := range urls {
+		if id, err := codes.Decode(url.Alias); err == nil && url.Alias != "" {
+			aliases = append(aliases, url.Alias)
+			ids = append(ids, int64(id))
+		}
+	}
+
+	shadowing := make(map[string]bool)
+	if len(aliases) == 0 {
+		return shadowing, nil
+	}
+	row, err := tx.Query(ctx,
+		"select u.alias from unnest($1::text[], $2::bigint[]) as u(alias, id) "+
+			"join public.storage s on s.id = u.id and coalesce(s.code_kind, '') = $3",
+		aliases, ids, codeKind(codes))
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+	for row.Next() {
+		var alias string
+		if err := row.Scan(&alias); err != nil {
+			return nil, err
+		}
+		shadowing[alias] = true
+	}
+	return shadowing, row.Err()
+}
+
+// reserveIDs takes n ids for new records from the sequence, skipping the ones
+// whose codes are taken by an alias, stored or being added, or look like legacy ids
+func (db *Database) reserveIDs(ctx context.Context, tx pgx.Tx, n int, aliases []string) ([]int64, error) {
+	ids := make([]int64, 0, n)
+	adding := make(map[string]bool, len(aliases))
+	for _, alias := range aliases {
+		adding[alias] = true
+	}
+
+	for len(ids) < n {
+		var (
+			reserved []int64
+			codes    []string
+		)
+
+		row, err := tx.Query(ctx,
+			"select nextval(pg_get_serial_sequence('public.storage', 'id')) from generate_series(1, $1::int)", n-len(ids))
+		if err != nil {
+			return nil, err
+		}
+		for row.Next() {
+			var id int64
+			if err := row.Scan(&id); err != nil {
+				row.Close()
+				return nil, err
+			}
+			reserved = append(reserved, id)
+			codes = append(codes, codesOrDefault(db.Codes).Encode(int(id)))
+		}
+		row.Close()
+		if err := row.Err(); err != nil {
+			return nil, err
+		}
+
+		taken := make(map[string]bool)
+		if codeKind(db.Codes) != "" {
+			row, err := tx.Query(ctx, "select alias from public.storage where alias = any($1)", codes)
+			if err != nil {
+				return nil, err
+			}
+			for row.Next() {
+				var alias string
+				if err := row.Scan(&alias); err != nil {
+					row.Close()
+					return nil, err
+				}
+				taken[alias] = true
+			}
+			row.Close()
+			if err := row.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		for i, id := range reserved {
+			if codeKind(db.Codes) == "" || !taken[codes[i]] && !adding[codes[i]] && !shadowsLegacy(db.Codes, codes[i]) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (db *Database) AddURL(ctx context.Context, url URL, user string) (string, error) {
+	results, err := db.AddURLs(ctx, []URL{url}, user, false)
+	if err != nil {
+		return "", err
+	}
+	return results[0].ShortURL, results[0].Err
 }
 
-func (db *Database) AddURL(ctx context.Context, url string, user string) (string, error) {
-	var newID int64
+func (db *Database) AddURLs(ctx context.Context, urls []URL, user string, atomic bool) ([]AddResult, error) {
+	if err := db.connected(); err != nil {
+		return nil, err
+	}
+
+	var (
+		fullURLs, aliases []string
+		expiresAt         []*time.Time
+		inserted          = make(map[string]int64)
+		first             = make(map[string]int)
+	)
+
+	results := make([]AddResult, len(urls))
 
-	row := db.ConnPool.QueryRow(ctx,
-		"INSERT INTO public.storage (full_url, user_id) VALUES ($1, $2) RETURNING id", url, user)
-	if err := row.Scan(&newID); err != nil {
-		id, err := db.SearchID(ctx, url)
-		if err == nil {
-			return db.BaseURL + strconv.Itoa(id), middleware.ErrConflict
+	tx, err := db.ConnPool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	shadowing, err := db.shadowingAliases(ctx, tx, urls)
+	if err != nil {
+		return nil, err
+	}
+	for i, url := range urls {
+		if err := checkAlias(url.Alias); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if shadowing[url.Alias] {
+			results[i].Err = middleware.ErrAliasConflict
+			continue
+		}
+		if _, found := first[url.FullURL]; found {
+			continue
+		}
+		first[url.FullURL] = i
+
+		url := url
+		fullURLs = append(fullURLs, url.FullURL)
+		aliases = append(aliases, url.Alias)
+		if url.ExpiresAt.IsZero() {
+			expiresAt = append(expiresAt, nil)
 		} else {
-			return "", middleware.ErrConflict
+			expiresAt = append(expiresAt, &url.ExpiresAt)
 		}
-	} else {
-		return db.BaseURL + strconv.FormatInt(newID, 10), nil
 	}
+
+	ids, err := db.reserveIDs(ctx, tx, len(fullURLs), aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := tx.Query(ctx,
+		"insert into public.storage (id, full_url, user_id, alias, code_kind, expires_at) "+
+			"select u.id, u.full_url, $1, nullif(u.alias, ''), nullif($2, ''), u.expires_at "+
+			"from unnest($3::bigint[], $4::text[], $5::text[], $6::timestamptz[]) with ordinality "+
+			"as u(id, full_url, alias, expires_at, n) order by u.n on conflict do nothing returning id, full_url",
+		user, codeKind(db.Codes), ids, fullURLs, aliases, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	for row.Next() {
+		var (
+			id      int64
+			fullURL string
+		)
+		if err := row.Scan(&id, &fullURL); err != nil {
+			row.Close()
+			return nil, err
+		}
+		inserted[fullURL] = id
+	}
+	row.Close()
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+
+	existing := make(map[string]string)
+	row, err = tx.Query(ctx,
+		"select full_url, id, coalesce(alias, ''), coalesce(code_kind, '') from public.storage where full_url = any($1)",
+		fullURLs)
+	if err != nil {
+		return nil, err
+	}
+	for row.Next() {
+		var (
+			id                   int32
+			fullURL, alias, kind string
+		)
+		if err := row.Scan(&fullURL, &id, &alias, &kind); err != nil {
+			row.Close()
+			return nil, err
+		}
+		existing[fullURL] = db.shortURL(int(id), alias, kind)
+	}
+	row.Close()
+	if err := row.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, url := range urls {
+		if results[i].Err != nil {
+			continue
+		}
+		shortURL, found := existing[url.FullURL]
+		if _, created := inserted[url.FullURL]; created && first[url.FullURL] == i {
+			results[i].ShortURL = shortURL
+		} else if found {
+			results[i] = AddResult{ShortURL: shortURL, Err: middleware.ErrConflict}
+		} else {
+			results[i].Err = middleware.ErrAliasConflict
+		}
+	}
+
+	if atomic && batchFailed(results) {
+		markRolledBack(results)
+		return results, tx.Rollback(ctx)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
-func (db *Database) SearchURL(ctx context.Context, id int) (string, error) {
-	var url string
+func (db *Database) SearchURL(ctx context.Context, short string) (string, error) {
+	if err := db.connected(); err != nil {
+		return "", err
+	}
+
+	var (
+		url       string
+		isDeleted bool
+		found     bool
+	)
 
-	row, err := db.ConnPool.Query(ctx, "select full_url from public.storage where id = $1", id)
+	row, err := db.ConnPool.Query(ctx,
+		"select full_url, is_deleted or coalesce(expires_at <= now(), false) from public.storage "+
+			"where "+resolveCondition+" "+resolveOrder,
+		db.resolveArgs(short)...)
 
 	if err != nil {
 		return "", err
@@ -267,24 +1365,37 @@ func (db *Database) SearchURL(ctx context.Context, id int) (string, error) {
 		} else {
 			url = value[0].(string)
 		}
+		isDeleted = value[1].(bool)
+		found = true
 	}
 
 	if err := row.Err(); err != nil {
 		return "", err
 	}
 
+	if !found {
+		return "", middleware.ErrNotFound
+	} else if isDeleted {
+		return "", middleware.ErrGone
+	}
 	return url, nil
 
 }
 
 func (db *Database) GetAllURLForUser(ctx context.Context, user string) ([]middleware.JSONStructForAuth, error) {
+	if err := db.connected(); err != nil {
+		return nil, err
+	}
+
 	var (
 		JSONStructList []middleware.JSONStructForAuth
 		JSONStruct     middleware.JSONStructForAuth
 		returnErr      error
 	)
 
-	row, err := db.ConnPool.Query(ctx, "select id, full_url from public.storage where user_id = $1", user)
+	row, err := db.ConnPool.Query(ctx,
+		"select id, full_url, coalesce(alias, ''), coalesce(code_kind, '') from public.storage "+
+			"where user_id = $1 and not is_deleted and (expires_at is null or expires_at > now()) order by id", user)
 
 	if err != nil {
 		return nil, err
@@ -299,7 +1410,7 @@ func (db *Database) GetAllURLForUser(ctx context.Context, user string) ([]middle
 			return nil, err
 		}
 
-		JSONStruct.ShortURL = db.BaseURL + strconv.FormatInt(int64(value[0].(int32)), 10)
+		JSONStruct.ShortURL = db.shortURL(int(value[0].(int32)), value[2].(string), value[3].(string))
 		JSONStruct.OriginalURL = value[1].(string)
 		JSONStructList = append(JSONStructList, JSONStruct)
 	}
@@ -310,7 +1421,7 @@ func (db *Database) GetAllURLForUser(ctx context.Context, user string) ([]middle
 			return nil, err
 		}
 
-		JSONStruct.ShortURL = db.BaseURL + strconv.FormatInt(int64(value[0].(int32)), 10)
+		JSONStruct.ShortURL = db.shortURL(int(value[0].(int32)), value[2].(string), value[3].(string))
 		JSONStruct.OriginalURL = value[1].(string)
 		JSONStructList = append(JSONStructList, JSONStruct)
 	}
@@ -319,24 +1430,32 @@ func (db *Database) GetAllURLForUser(ctx context.Context, user string) ([]middle
 		return nil, err
 	}
 
-	fmt.Sprintln(JSONStructList)
 	return JSONStructList, returnErr
 }
 
-func (db *Database) SearchID(ctx context.Context, url string) (int, error) {
-	var id int
+func (db *Database) SearchID(ctx context.Context, url string) (int, string, string, error) {
+	if err := db.connected(); err != nil {
+		return 0, "", "", err
+	}
+
+	var (
+		id    int
+		alias string
+		kind  string
+	)
 
-	row, err := db.ConnPool.Query(ctx, "select id from public.storage where full_url = $1", url)
+	row, err := db.ConnPool.Query(ctx,
+		"select id, coalesce(alias, ''), coalesce(code_kind, '') from public.storage where full_url = $1", url)
 
 	if err != nil {
-		return 0, err
+		return 0, "", "", err
 	}
 	defer row.Close()
 
 	for row.Next() {
 		value, err := row.Values()
 		if err != nil {
-			return 0, err
+			return 0, "", "", err
 		}
 
 		if value[0] == nil {
@@ -344,12 +1463,144 @@ func (db *Database) SearchID(ctx context.Context, url string) (int, error) {
 		} else {
 			id = int(value[0].(int32))
 		}
+		alias = value[1].(string)
+		kind = value[2].(string)
 	}
 
 	if err := row.Err(); err != nil {
+		return 0, "", "", err
+	}
+
+	return id, alias, kind, nil
+
+}
+
+func (db *Database) DeleteURLs(ctx context.Context, user string, ids []string) error {
+	if err := db.connected(); err != nil {
+		return err
+	}
+
+	var decodedIDs, legacyIDs []int64
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	for _, id := range ids {
+		decoded, legacy := resolveParams(db.Codes, id)
+		decodedIDs = append(decodedIDs, decoded)
+		legacyIDs = append(legacyIDs, legacy)
+	}
+
+	_, err := db.ConnPool.Exec(ctx,
+		"update public.storage set is_deleted = true where user_id = $1 and id in ("+
+			"select distinct on (s.short) st.id "+
+			"from unnest($2::text[], $3::bigint[], $4::bigint[]) as s(short, decoded, legacy) "+
+			"join public.storage st on st.alias = s.short "+
+			"or (st.id = s.decoded and coalesce(st.code_kind, '') = $5) or (st.id = s.legacy and st.code_kind is null) "+
+			"order by s.short, case when st.alias = s.short then 0 else 1 end)",
+		user, ids, decodedIDs, legacyIDs, codeKind(storedCodes(db.Codes)))
+	return err
+}
+
+func (db *Database) PurgeExpired(ctx context.Context) (int, error) {
+	if err := db.connected(); err != nil {
+		return 0, err
+	}
+
+	res, err := db.ConnPool.Exec(ctx,
+		"update public.storage set is_deleted = true where expires_at <= now() and not is_deleted")
+	if err != nil {
 		return 0, err
 	}
+	return int(res.RowsAffected()), nil
+}
+
+func (db *Database) GetStats(ctx context.Context) (middleware.JSONInternalStats, error) {
+	if err := db.connected(); err != nil {
+		return middleware.JSONInternalStats{}, err
+	}
+
+	var stats middleware.JSONInternalStats
+
+	err := db.ConnPool.QueryRow(ctx,
+		"select count(*), count(distinct nullif(user_id, '')) from public.storage "+
+			"where not is_deleted and (expires_at is null or expires_at > now())").Scan(&stats.URLs, &stats.Users)
+	return stats, err
+}
+
+func (db *Database) RecordClick(ctx context.Context, short string, at time.Time) error {
+	if err := db.connected(); err != nil {
+		return err
+	}
+
+	res, err := db.ConnPool.Exec(ctx,
+		"insert into public.clicks (url_id, day, total, last_accessed) "+
+			"select id, ($5::timestamptz at time zone 'UTC')::date, 1, $5::timestamptz from public.storage "+
+			"where "+resolveCondition+" "+resolveOrder+" "+
+			"on conflict (url_id, day) do update set total = clicks.total + 1, "+
+			"last_accessed = greatest(clicks.last_accessed, excluded.last_accessed)",
+		db.resolveArgs(short, at)...)
+	if err != nil {
+		return err
+	} else if res.RowsAffected() == 0 {
+		return middleware.ErrNotFound
+	}
+	return nil
+}
+
+func (db *Database) GetURLStats(ctx context.Context, user string, short string) (middleware.JSONURLStats, error) {
+	if err := db.connected(); err != nil {
+		return middleware.JSONURLStats{}, err
+	}
 
-	return id, nil
+	var (
+		id                          int32
+		fullURL, alias, kind, owner string
+		stats                       middleware.JSONURLStats
+	)
+
+	err := db.ConnPool.QueryRow(ctx,
+		"select id, full_url, coalesce(alias, ''), coalesce(code_kind, ''), coalesce(user_id, '') "+
+			"from public.storage where "+resolveCondition+" "+resolveOrder,
+		db.resolveArgs(short)...).Scan(&id, &fullURL, &alias, &kind, &owner)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return stats, middleware.ErrNotFound
+	} else if err != nil {
+		return stats, err
+	} else if owner != user {
+		return stats, middleware.ErrForbidden
+	}
+
+	stats = middleware.JSONURLStats{
+		ShortURL:    db.shortURL(int(id), alias, kind),
+		OriginalURL: fullURL,
+		Daily:       []middleware.JSONDailyClicks{},
+	}
+
+	row, err := db.ConnPool.Query(ctx,
+		"select day, total, last_accessed from public.clicks where url_id = $1 order by day", id)
+	if err != nil {
+		return stats, err
+	}
+	defer row.Close()
+
+	for row.Next() {
+		var (
+			day          time.Time
+			total        int64
+			lastAccessed time.Time
+		)
+		if err := row.Scan(&day, &total, &lastAccessed); err != nil {
+			return stats, err
+		}
+
+		stats.Clicks += total
+		if stats.LastAccessed == nil || lastAccessed.After(*stats.LastAccessed) {
+			stats.LastAccessed = &lastAccessed
+		}
+		stats.Daily = append(stats.Daily, middleware.JSONDailyClicks{Date: day.Format(dayLayout), Clicks: total})
+	}
 
+	return stats, row.Err()
 }
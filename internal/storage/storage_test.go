@@ -0,0 +1,181 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"github.com/pressly/goose/v3"
+	m "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	s "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage/storagetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const baseURL = "http://localhost:8080/"
+
+func newMemory() *s.Memory {
+	return &s.Memory{
+		BaseURL:   baseURL,
+		URLID:     make(map[string]int),
+		IDURL:     make(map[int]string),
+		UserURLs:  make(map[string][]int),
+		Deleted:   make(map[int]bool),
+		Aliases:   make(map[string]int),
+		IDAlias:   make(map[int]string),
+		ExpiresAt: make(map[int]time.Time),
+		Clicks:    make(map[int]*s.ClickStats),
+	}
+}
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) s.Storage {
+		return newMemory()
+	})
+}
+
+func TestFile(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) s.Storage {
+		return &s.File{
+			BaseURL:   baseURL,
+			Filepath:  filepath.Join(t.TempDir(), "storage.json"),
+			URLID:     make(map[string]int),
+			IDURL:     make(map[int]string),
+			UserURLs:  make(map[string][]int),
+			Deleted:   make(map[int]bool),
+			Aliases:   make(map[string]int),
+			IDAlias:   make(map[int]string),
+			CodeKinds: make(map[int]string),
+			ExpiresAt: make(map[int]time.Time),
+			Clicks:    make(map[int]*s.ClickStats),
+		}
+	})
+}
+
+func TestSQLite(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) s.Storage {
+		sqliteItem := &s.SQLite{
+			BaseURL: baseURL,
+			Path:    filepath.Join(t.TempDir(), "storage.db"),
+		}
+
+		db, err := sqliteItem.GetDBConnection()
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		sqliteItem.DB = db
+
+		require.NoError(t, goose.SetDialect("sqlite3"))
+		require.NoError(t, goose.Up(db, filepath.Join("..", "migrations", "sqlite")))
+		return sqliteItem
+	})
+}
+
+// TestDatabase wipes the storage table, so it runs only against a database given in TEST_DATABASE_DSN
+func TestDatabase(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	db, err := goose.OpenDBWithDriver("pgx", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, goose.Up(db, filepath.Join("..", "migrations")))
+
+	storagetest.Run(t, func(t *testing.T) s.Storage {
+		ctx := context.Background()
+		DBItem := &s.Database{
+			BaseURL:   baseURL,
+			DBConnURL: dsn,
+		}
+
+		pool, err := DBItem.GetDBConnection(ctx)
+		require.NoError(t, err)
+		t.Cleanup(pool.Close)
+		DBItem.ConnPool = pool
+
+		_, err = DBItem.Exec(ctx, "truncate table public.storage restart identity cascade")
+		require.NoError(t, err)
+		return DBItem
+	})
+}
+
+func TestDatabaseDisconnected(t *testing.T) {
+	ctx := context.Background()
+	refused := errors.New("connection refused")
+	DBItem := &s.Database{BaseURL: baseURL, DBErrorConnect: refused}
+
+	_, err := DBItem.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "user")
+	assert.ErrorIs(t, err, refused)
+	_, err = DBItem.AddURLs(ctx, []s.URL{{FullURL: "https://github.com/"}}, "user", false)
+	assert.ErrorIs(t, err, refused)
+	_, err = DBItem.SearchURL(ctx, "1")
+	assert.ErrorIs(t, err, refused)
+	_, err = DBItem.GetAllURLForUser(ctx, "user")
+	assert.ErrorIs(t, err, refused)
+	_, err = DBItem.PurgeExpired(ctx)
+	assert.ErrorIs(t, err, refused)
+	assert.ErrorIs(t, DBItem.DeleteURLs(ctx, "user", []string{"1"}), refused)
+	assert.ErrorIs(t, DBItem.RecordClick(ctx, "1", time.Now()), refused)
+	_, err = DBItem.GetURLStats(ctx, "user", "1")
+	assert.ErrorIs(t, err, refused)
+	_, err = DBItem.GetStats(ctx)
+	assert.ErrorIs(t, err, refused)
+	assert.ErrorIs(t, DBItem.Ping(ctx), refused)
+	assert.NoError(t, DBItem.Close())
+}
+
+func TestSelfLinks(t *testing.T) {
+	ctx := context.Background()
+	memoryItem := newMemory()
+
+	target, err := memoryItem.AddURL(ctx, s.URL{FullURL: "https://go.dev/"}, "user")
+	require.NoError(t, err)
+	// a chain stored before short URLs were checked, it takes 3 hops to get to the target
+	chain := target
+	for i := 0; i < 2; i++ {
+		chain, err = memoryItem.AddURL(ctx, s.URL{FullURL: chain}, "user")
+		require.NoError(t, err)
+	}
+
+	selfLinks, err := s.NewSelfLinks(memoryItem, 2, baseURL, "https://Sho.rt")
+	require.NoError(t, err)
+
+	gone, err := memoryItem.AddURL(ctx, s.URL{FullURL: "https://example.org/"}, "user")
+	require.NoError(t, err)
+	require.NoError(t, memoryItem.DeleteURLs(ctx, "user", []string{gone[len(baseURL):]}))
+
+	for _, url := range []string{
+		target, baseURL + "2", "https://sho.rt/1?utm_source=mail", "http://sho.rt:80/1", "https://localhost:8080/2",
+	} {
+		short, err := selfLinks.AddURL(ctx, s.URL{FullURL: url}, "other")
+		assert.ErrorIs(t, err, m.ErrConflict, url)
+		assert.Equal(t, target, short, "%s must be collapsed to its target", url)
+	}
+	for _, url := range []string{chain, gone} {
+		_, err = selfLinks.AddURL(ctx, s.URL{FullURL: url}, "other")
+		assert.ErrorIs(t, err, m.ErrRedirectLoop, url)
+	}
+	for _, url := range []string{baseURL + "api/user/urls", baseURL + "ping", baseURL + "999", "http://sho.rt:443/1"} {
+		_, err = selfLinks.AddURL(ctx, s.URL{FullURL: url}, "other")
+		assert.NoError(t, err, "%s is not a short URL", url)
+	}
+
+	results, err := selfLinks.AddURLs(ctx, []s.URL{
+		{FullURL: target}, {FullURL: "https://example.com/"}, {FullURL: chain},
+	}, "other", false)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.ErrorIs(t, results[0].Err, m.ErrConflict)
+	assert.Equal(t, target, results[0].ShortURL)
+	assert.NoError(t, results[1].Err)
+	assert.ErrorIs(t, results[2].Err, m.ErrRedirectLoop)
+
+	rejecting, err := s.NewSelfLinks(memoryItem, 0, baseURL)
+	require.NoError(t, err)
+	_, err = rejecting.AddURL(ctx, s.URL{FullURL: target}, "other")
+	assert.ErrorIs(t, err, m.ErrRedirectLoop)
+}
@@ -0,0 +1,310 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	m "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	s "github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Run checks that a storage keeps the contract the handlers rely on,
+// newStorage must return an empty storage every time it is called
+func Run(t *testing.T, newStorage func(t *testing.T) s.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, st s.Storage)
+	}{
+		{"AddAndSearch", testAddAndSearch},
+		{"DuplicateURL", testDuplicateURL},
+		{"AddURLs", testAddURLs},
+		{"AddURLsAtomic", testAddURLsAtomic},
+		{"NotFound", testNotFound},
+		{"UserURLs", testUserURLs},
+		{"NoContent", testNoContent},
+		{"Delete", testDelete},
+		{"Stats", testStats},
+		{"ConcurrentAdd", testConcurrentAdd},
+		{"ConcurrentDuplicate", testConcurrentDuplicate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func code(shortURL string) string {
+	return shortURL[strings.LastIndex(shortURL, "/")+1:]
+}
+
+func testAddAndSearch(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	first, err := st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "user")
+	require.NoError(t, err)
+	second, err := st.AddURL(ctx, s.URL{FullURL: "https://www.google.ru/"}, "user")
+	require.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	url, err := st.SearchURL(ctx, code(first))
+	require.NoError(t, err)
+	assert.Equal(t, "https://github.com/", url)
+
+	url, err = st.SearchURL(ctx, code(second))
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.google.ru/", url)
+}
+
+func testDuplicateURL(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	first, err := st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "user")
+	require.NoError(t, err)
+
+	for _, user := range []string{"user", "other"} {
+		again, err := st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, user)
+		assert.ErrorIs(t, err, m.ErrConflict)
+		assert.Equal(t, first, again)
+	}
+
+	list, err := st.GetAllURLForUser(ctx, "user")
+	require.NoError(t, err)
+	assert.Len(t, list, 1)
+	_, err = st.GetAllURLForUser(ctx, "other")
+	assert.ErrorIs(t, err, m.ErrNoContent)
+}
+
+func testAddURLs(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	existing, err := st.AddURL(ctx, s.URL{FullURL: "https://github.com/", Alias: "gh"}, "other")
+	require.NoError(t, err)
+
+	results, err := st.AddURLs(ctx, []s.URL{
+		{FullURL: "https://www.google.ru/"},
+		{FullURL: "https://github.com/"},
+		{FullURL: "https://practicum.yandex.ru/", Alias: "not/valid"},
+		{FullURL: "https://go.dev/", Alias: "gh"},
+		{FullURL: "https://www.google.ru/"},
+		{FullURL: "https://practicum.yandex.ru/", Alias: "ya"},
+	}, "user", false)
+	require.NoError(t, err)
+	require.Len(t, results, 6)
+
+	assert.NoError(t, results[0].Err)
+	assert.ErrorIs(t, results[1].Err, m.ErrConflict)
+	assert.Equal(t, existing, results[1].ShortURL)
+	assert.ErrorIs(t, results[2].Err, m.ErrInvalidAlias)
+	assert.ErrorIs(t, results[3].Err, m.ErrAliasConflict)
+	assert.ErrorIs(t, results[4].Err, m.ErrConflict)
+	assert.Equal(t, results[0].ShortURL, results[4].ShortURL)
+	assert.NoError(t, results[5].Err)
+	assert.Equal(t, "ya", code(results[5].ShortURL))
+
+	list, err := st.GetAllURLForUser(ctx, "user")
+	require.NoError(t, err)
+	assert.Equal(t, []m.JSONStructForAuth{
+		{ShortURL: results[0].ShortURL, OriginalURL: "https://www.google.ru/"},
+		{ShortURL: results[5].ShortURL, OriginalURL: "https://practicum.yandex.ru/"},
+	}, list)
+
+	results, err = st.AddURLs(ctx, nil, "user", false)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func testAddURLsAtomic(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	existing, err := st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "user")
+	require.NoError(t, err)
+
+	results, err := st.AddURLs(ctx, []s.URL{
+		{FullURL: "https://www.google.ru/", Alias: "google"},
+		{FullURL: "https://github.com/"},
+		{FullURL: "https://practicum.yandex.ru/"},
+	}, "user", true)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	assert.ErrorIs(t, results[0].Err, m.ErrRolledBack)
+	assert.ErrorIs(t, results[1].Err, m.ErrConflict)
+	assert.Equal(t, existing, results[1].ShortURL)
+	assert.ErrorIs(t, results[2].Err, m.ErrRolledBack)
+
+	_, err = st.SearchURL(ctx, "google")
+	assert.ErrorIs(t, err, m.ErrNotFound)
+	list, err := st.GetAllURLForUser(ctx, "user")
+	require.NoError(t, err)
+	assert.Equal(t, []m.JSONStructForAuth{{ShortURL: existing, OriginalURL: "https://github.com/"}}, list)
+
+	results, err = st.AddURLs(ctx, []s.URL{
+		{FullURL: "https://www.google.ru/", Alias: "google"},
+		{FullURL: "https://practicum.yandex.ru/"},
+	}, "user", true)
+	require.NoError(t, err)
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+	}
+	url, err := st.SearchURL(ctx, "google")
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.google.ru/", url)
+}
+
+func testNotFound(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	for _, short := range []string{"1", "999999", "spring-sale", ""} {
+		_, err := st.SearchURL(ctx, short)
+		assert.ErrorIs(t, err, m.ErrNotFound, short)
+	}
+
+	_, err := st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "user")
+	require.NoError(t, err)
+	_, err = st.SearchURL(ctx, "999999")
+	assert.ErrorIs(t, err, m.ErrNotFound)
+}
+
+func testUserURLs(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	first, err := st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "user")
+	require.NoError(t, err)
+	other, err := st.AddURL(ctx, s.URL{FullURL: "https://practicum.yandex.ru/"}, "other")
+	require.NoError(t, err)
+	second, err := st.AddURL(ctx, s.URL{FullURL: "https://www.google.ru/"}, "user")
+	require.NoError(t, err)
+
+	list, err := st.GetAllURLForUser(ctx, "user")
+	require.NoError(t, err)
+	assert.Equal(t, []m.JSONStructForAuth{
+		{ShortURL: first, OriginalURL: "https://github.com/"},
+		{ShortURL: second, OriginalURL: "https://www.google.ru/"},
+	}, list)
+
+	list, err = st.GetAllURLForUser(ctx, "other")
+	require.NoError(t, err)
+	assert.Equal(t, []m.JSONStructForAuth{{ShortURL: other, OriginalURL: "https://practicum.yandex.ru/"}}, list)
+}
+
+func testNoContent(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	_, err := st.GetAllURLForUser(ctx, "user")
+	assert.ErrorIs(t, err, m.ErrNoContent)
+
+	_, err = st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "other")
+	require.NoError(t, err)
+	_, err = st.GetAllURLForUser(ctx, "user")
+	assert.ErrorIs(t, err, m.ErrNoContent)
+}
+
+func testDelete(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	own, err := st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "user")
+	require.NoError(t, err)
+	foreign, err := st.AddURL(ctx, s.URL{FullURL: "https://www.google.ru/"}, "other")
+	require.NoError(t, err)
+
+	require.NoError(t, st.DeleteURLs(ctx, "user", []string{code(own), code(foreign), "999999"}))
+
+	_, err = st.SearchURL(ctx, code(own))
+	assert.ErrorIs(t, err, m.ErrGone)
+	url, err := st.SearchURL(ctx, code(foreign))
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.google.ru/", url)
+
+	_, err = st.GetAllURLForUser(ctx, "user")
+	assert.ErrorIs(t, err, m.ErrNoContent)
+}
+
+func testStats(t *testing.T, st s.Storage) {
+	ctx := context.Background()
+
+	stats, err := st.GetStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, m.JSONInternalStats{}, stats)
+
+	_, err = st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, "user")
+	require.NoError(t, err)
+	_, err = st.AddURL(ctx, s.URL{FullURL: "https://go.dev/"}, "user")
+	require.NoError(t, err)
+	deleted, err := st.AddURL(ctx, s.URL{FullURL: "https://www.google.ru/"}, "other")
+	require.NoError(t, err)
+	require.NoError(t, st.DeleteURLs(ctx, "other", []string{code(deleted)}))
+
+	stats, err = st.GetStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, m.JSONInternalStats{URLs: 2, Users: 1}, stats)
+}
+
+func testConcurrentAdd(t *testing.T, st s.Storage) {
+	const workers = 32
+
+	var wg sync.WaitGroup
+
+	ctx := context.Background()
+	shorts := make([]string, workers)
+	errs := make([]error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shorts[i], errs[i] = st.AddURL(ctx, s.URL{FullURL: fmt.Sprintf("https://example.com/%d", i)}, "user")
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, workers)
+	for i := 0; i < workers; i++ {
+		require.NoError(t, errs[i])
+		assert.False(t, seen[shorts[i]], shorts[i])
+		seen[shorts[i]] = true
+
+		url, err := st.SearchURL(ctx, code(shorts[i]))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("https://example.com/%d", i), url)
+	}
+
+	list, err := st.GetAllURLForUser(ctx, "user")
+	require.NoError(t, err)
+	assert.Len(t, list, workers)
+}
+
+func testConcurrentDuplicate(t *testing.T, st s.Storage) {
+	const workers = 16
+
+	var wg sync.WaitGroup
+
+	ctx := context.Background()
+	shorts := make([]string, workers)
+	errs := make([]error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shorts[i], errs[i] = st.AddURL(ctx, s.URL{FullURL: "https://github.com/"}, fmt.Sprintf("user%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for i := 0; i < workers; i++ {
+		if errs[i] == nil {
+			created++
+		} else if !errors.Is(errs[i], m.ErrConflict) {
+			t.Fatalf("unexpected error: %v", errs[i])
+		}
+		assert.Equal(t, shorts[0], shorts[i])
+	}
+	assert.Equal(t, 1, created)
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"github.com/rusMatryoska/yandex-practicum-go-developer-sprint-3/internal/middleware"
+	"log"
+	"time"
+)
+
+// deleteQueueSize is how many tasks wait for the worker, it is not tied to the batch size
+// since tasks keep coming while a batch is deleted
+const deleteQueueSize = 1024
+
+type DeleteTask struct {
+	User string
+	IDs  []string
+}
+
+type DeleteWorker struct {
+	storage   Storage
+	tasks     chan DeleteTask
+	done      chan struct{}
+	batchSize int
+	interval  time.Duration
+}
+
+func NewDeleteWorker(st Storage, batchSize int, interval time.Duration) *DeleteWorker {
+	return &DeleteWorker{
+		storage:   st,
+		tasks:     make(chan DeleteTask, deleteQueueSize),
+		done:      make(chan struct{}),
+		batchSize: batchSize,
+		interval:  interval,
+	}
+}
+
+// Push queues task without waiting for the worker, it fails when the queue is full or the worker is stopped
+func (dw *DeleteWorker) Push(task DeleteTask) error {
+	select {
+	case <-dw.done:
+		return middleware.ErrQueueFull
+	default:
+	}
+
+	select {
+	case dw.tasks <- task:
+		return nil
+	default:
+		return middleware.ErrQueueFull
+	}
+}
+
+func (dw *DeleteWorker) Run(ctx context.Context) {
+	var (
+		pending = make(map[string][]string)
+		count   int
+	)
+
+	ticker := time.NewTicker(dw.interval)
+	defer ticker.Stop()
+	defer close(dw.done)
+
+	add := func(task DeleteTask) {
+		pending[task.User] = append(pending[task.User], task.IDs...)
+		count += len(task.IDs)
+	}
+
+	flush := func() {
+		for user, ids := range pending {
+			if err := dw.storage.DeleteURLs(context.Background(), user, ids); err != nil {
+				log.Printf("failed to delete urls of user %s: %v", user, err)
+			}
+		}
+		pending = make(map[string][]string)
+		count = 0
+	}
+
+	for {
+		select {
+		case task := <-dw.tasks:
+			add(task)
+			if count >= dw.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			if count > 0 {
+				flush()
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case task := <-dw.tasks:
+					add(task)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func RunReaper(ctx context.Context, st Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			count, err := st.PurgeExpired(ctx)
+			if err != nil {
+				log.Printf("failed to purge expired urls: %v", err)
+			} else if count > 0 {
+				log.Println(count, "expired urls were purged")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunClickFlusher writes the clicks of f to disk every interval, the last ones are written by f.Close
+func RunClickFlusher(ctx context.Context, f *File, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.FlushClicks(); err != nil {
+				log.Printf("failed to write click statistics: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func RunCompactor(ctx context.Context, f *File, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if f.Stale() == 0 {
+				continue
+			}
+			if err := f.Compact(); err != nil {
+				log.Printf("failed to compact storage file: %v", err)
+			} else {
+				log.Println("storage file", f.Filepath, "compacted")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}